@@ -0,0 +1,119 @@
+package main
+
+import (
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/middleware/jwt"
+	"github.com/spf13/viper"
+)
+
+// AdminClaims are the claims of an admin token, which is told apart from connection tokens by its audience
+type AdminClaims struct {
+	Subject string `json:"sub"`
+}
+
+type PrewarmRequest struct {
+	SshConnectionCredentials
+	// Bastion pools the connection as a jump host instead of a regular host
+	Bastion bool `json:"bastion"`
+}
+
+func (request *PrewarmRequest) key() string {
+	if request.Bastion {
+		return "bastion:" + request.SshConnectionCredentials.key()
+	}
+
+	return request.SshConnectionCredentials.key()
+}
+
+// adminRoutes registers the connection pool admin API, it has its own verifier and has to be registered before
+// the connection token verifier is used
+func adminRoutes(app *iris.Application) {
+	verifier := jwt.NewVerifier(jwt.HS256, []byte(viper.GetString("JWT_KEY")), jwt.Expected{
+		Audience: []string{viper.GetString("ADMIN_JWT_AUDIENCE")},
+	})
+	verifier.WithDefaultBlocklist()
+
+	admin := app.Party("/admin", verifier.Verify(func() interface{} {
+		return new(AdminClaims)
+	}))
+
+	admin.Get("/connections", func(ctx iris.Context) {
+		ctx.JSON(ListPooledConnections())
+	}).SetName("Admin list connections")
+
+	admin.Get("/connections/{id:string}", func(ctx iris.Context) {
+		connection, ok := DescribePooledConnection(ctx.Params().Get("id"))
+		if !ok {
+			ctx.StopWithProblem(iris.StatusNotFound, iris.NewProblem().
+				Title("Connection not found").
+				Type("connection_not_found").
+				Detail(ctx.Params().Get("id")))
+			return
+		}
+
+		ctx.JSON(connection)
+	}).SetName("Admin get connection")
+
+	admin.Delete("/connections/{id:string}", func(ctx iris.Context) {
+		if !ClosePooledConnection(ctx.Params().Get("id")) {
+			ctx.StopWithProblem(iris.StatusNotFound, iris.NewProblem().
+				Title("Connection not found").
+				Type("connection_not_found").
+				Detail(ctx.Params().Get("id")))
+			return
+		}
+
+		ctx.StatusCode(iris.StatusNoContent)
+	}).SetName("Admin close connection")
+
+	// Closes the connection for the given credentials, so that the caller does not have to know the connection id
+	admin.Post("/connections/close", func(ctx iris.Context) {
+		var request PrewarmRequest
+		if err := ctx.ReadJSON(&request); err != nil {
+			ctx.StopWithError(iris.StatusBadRequest, err)
+			return
+		}
+
+		if !closePooledConnectionForKey(request.key()) {
+			ctx.StopWithProblem(iris.StatusNotFound, iris.NewProblem().
+				Title("Connection not found").
+				Type("connection_not_found").
+				Detail("no pooled connection for the given credentials"))
+			return
+		}
+
+		ctx.StatusCode(iris.StatusNoContent)
+	}).SetName("Admin close connection by credentials")
+
+	// Pre-warms a connection so that the first request for the credentials does not pay for the handshake
+	admin.Post("/connections", func(ctx iris.Context) {
+		var request PrewarmRequest
+		if err := ctx.ReadJSON(&request); err != nil {
+			ctx.StopWithError(iris.StatusBadRequest, err)
+			return
+		}
+
+		connect := GetConnection
+		if request.Bastion {
+			connect = GetBastionConnection
+		}
+
+		handle, err := connect(ctx.Request().Context(), &request.SshConnectionCredentials)
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
+			return
+		}
+		handle.Close()
+
+		connection, ok := describePooledConnectionForKey(request.key())
+		if !ok {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Connection was closed while pre-warming").
+				Type("connection_lost")))
+			return
+		}
+
+		ctx.StatusCode(iris.StatusCreated)
+		ctx.JSON(connection)
+	}).SetName("Admin prewarm connection")
+}
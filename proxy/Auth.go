@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"sort"
+	"strings"
+)
+
+// AuthError is returned when the credentials cannot be used to authenticate, Type is the problem type reported to clients
+type AuthError struct {
+	Type  string
+	Title string
+	Err   error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Title, e.Err)
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// parsePrivateKey parses args.Pkey, decrypting it with args.Passphrase when the key is encrypted
+func parsePrivateKey(args *SshConnectionCredentials) (interface{}, error) {
+	key, err := ssh.ParseRawPrivateKey([]byte(args.Pkey))
+
+	var missingErr *ssh.PassphraseMissingError
+	if errors.As(err, &missingErr) {
+		if args.Passphrase == "" {
+			return nil, &AuthError{Type: "private_key_passphrase_required", Title: "Private key is encrypted and no passphrase was given", Err: err}
+		}
+
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase([]byte(args.Pkey), []byte(args.Passphrase))
+		if errors.Is(err, x509.IncorrectPasswordError) {
+			return nil, &AuthError{Type: "private_key_passphrase_invalid", Title: "Private key passphrase is incorrect", Err: err}
+		}
+	}
+
+	if err != nil {
+		return nil, &AuthError{Type: "private_key_invalid", Title: "Unable to parse private key", Err: err}
+	}
+
+	return key, nil
+}
+
+// parseCertificate parses args.Certificate and checks that it was issued for the private key
+func parseCertificate(args *SshConnectionCredentials, signer ssh.Signer) (*ssh.Certificate, error) {
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(args.Certificate))
+	if err != nil {
+		return nil, &AuthError{Type: "certificate_invalid", Title: "Unable to parse certificate", Err: err}
+	}
+
+	certificate, ok := publicKey.(*ssh.Certificate)
+	if !ok {
+		return nil, &AuthError{Type: "certificate_invalid", Title: "Unable to parse certificate", Err: fmt.Errorf("%s is not a certificate", publicKey.Type())}
+	}
+
+	if certificate.CertType != ssh.UserCert {
+		return nil, &AuthError{Type: "certificate_invalid", Title: "Certificate is not a user certificate", Err: fmt.Errorf("certificate type %d", certificate.CertType)}
+	}
+
+	if string(certificate.Key.Marshal()) != string(signer.PublicKey().Marshal()) {
+		return nil, &AuthError{Type: "certificate_key_mismatch", Title: "Certificate was not issued for the private key", Err: fmt.Errorf("certificate key %s does not match private key %s", ssh.FingerprintSHA256(certificate.Key), ssh.FingerprintSHA256(signer.PublicKey()))}
+	}
+
+	return certificate, nil
+}
+
+type interactiveAnswer struct {
+	prefix string
+	answer string
+}
+
+// orderInteractiveAnswers normalizes answer prefixes and orders them longest first, so that the first matching
+// prefix is also the most specific one
+func orderInteractiveAnswers(answers map[string]string) []interactiveAnswer {
+	ordered := make([]interactiveAnswer, 0, len(answers))
+	for prefix, answer := range answers {
+		ordered = append(ordered, interactiveAnswer{prefix: strings.ToLower(strings.TrimSpace(prefix)), answer: answer})
+	}
+
+	sort.Slice(ordered, func(i, j int) bool {
+		if len(ordered[i].prefix) != len(ordered[j].prefix) {
+			return len(ordered[i].prefix) > len(ordered[j].prefix)
+		}
+		if ordered[i].prefix != ordered[j].prefix {
+			return ordered[i].prefix < ordered[j].prefix
+		}
+		return ordered[i].answer < ordered[j].answer
+	})
+
+	return ordered
+}
+
+// keyboardInteractive answers prompts from args.InteractiveAnswers by the longest case insensitive prompt prefix,
+// hidden prompts without an explicit answer get the password
+func keyboardInteractive(args *SshConnectionCredentials) ssh.KeyboardInteractiveChallenge {
+	ordered := orderInteractiveAnswers(args.InteractiveAnswers)
+
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+
+		for i, question := range questions {
+			prompt := strings.ToLower(strings.TrimSpace(question))
+			answered := false
+
+			for _, candidate := range ordered {
+				if strings.HasPrefix(prompt, candidate.prefix) {
+					answers[i] = candidate.answer
+					answered = true
+					break
+				}
+			}
+
+			if !answered {
+				if echos[i] || args.Password == "" {
+					return nil, fmt.Errorf("no answer for keyboard interactive prompt %q", question)
+				}
+
+				answers[i] = args.Password
+			}
+		}
+
+		return answers, nil
+	}
+}
+
+// createAuth builds SSH auth methods from credentials. When the credentials contain a key, a keyring holding it
+// (and its certificate) is returned as well so that it can be forwarded to the remote host.
+func createAuth(args *SshConnectionCredentials) ([]ssh.AuthMethod, agent.Agent, error) {
+	var authMethod []ssh.AuthMethod
+	var keyring agent.Agent
+
+	if len(args.Pkey) > 0 {
+		key, err := parsePrivateKey(args)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			return nil, nil, &AuthError{Type: "private_key_invalid", Title: "Unable to parse private key", Err: err}
+		}
+
+		addedKey := agent.AddedKey{PrivateKey: key}
+
+		if len(args.Certificate) > 0 {
+			certificate, err := parseCertificate(args, signer)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			certSigner, err := ssh.NewCertSigner(certificate, signer)
+			if err != nil {
+				return nil, nil, &AuthError{Type: "certificate_invalid", Title: "Unable to use certificate", Err: err}
+			}
+
+			addedKey.Certificate = certificate
+			signer = certSigner
+		}
+
+		authMethod = append(authMethod, ssh.PublicKeys(signer))
+
+		keyring = agent.NewKeyring()
+		if err := keyring.Add(addedKey); err != nil {
+			return nil, nil, &AuthError{Type: "private_key_invalid", Title: "Unable to add private key to agent", Err: err}
+		}
+	}
+
+	if len(args.Password) > 0 {
+		authMethod = append(authMethod, ssh.Password(args.Password))
+	}
+
+	if len(args.Password) > 0 || len(args.InteractiveAnswers) > 0 {
+		authMethod = append(authMethod, ssh.KeyboardInteractive(keyboardInteractive(args)))
+	}
+
+	return authMethod, keyring, nil
+}
+
+// wrapHandshakeError returns the error the host key was rejected with and turns a rejected authentication into
+// AuthError, other dial errors are returned as they are
+func wrapHandshakeError(err error, hostKeyErr error) error {
+	if err != nil && hostKeyErr != nil {
+		return hostKeyErr
+	}
+
+	if err != nil && strings.Contains(err.Error(), "unable to authenticate") {
+		return &AuthError{Type: "auth_failed", Title: "Authentication rejected by host", Err: err}
+	}
+
+	return err
+}
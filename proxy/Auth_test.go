@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestKeyboardInteractiveLongestPrefix(t *testing.T) {
+	challenge := keyboardInteractive(&SshConnectionCredentials{
+		Password: "secret",
+		InteractiveAnswers: map[string]string{
+			"verification":      "short",
+			"Verification code": "long",
+			"verification c":    "middle",
+		},
+	})
+
+	// Map order changes between runs, the answer must not
+	for i := 0; i < 50; i++ {
+		answers, err := challenge("test", "", []string{"Verification code:", "Password:"}, []bool{true, false})
+		if err != nil {
+			t.Fatalf("challenge failed: %s", err)
+		}
+		if answers[0] != "long" {
+			t.Fatalf("expected the longest prefix to answer, got %q", answers[0])
+		}
+		if answers[1] != "secret" {
+			t.Fatalf("expected the hidden prompt to get the password, got %q", answers[1])
+		}
+	}
+}
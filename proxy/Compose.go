@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/middleware/jwt"
+	"go.opentelemetry.io/otel"
+	"gopkg.in/yaml.v3"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var composeTracer = otel.Tracer("Compose")
+
+const defaultComposeTimeout = 10 * time.Minute
+
+type ComposeProject struct {
+	Project   string   `json:"project"`
+	Directory string   `json:"directory" validate:"required"`
+	File      string   `json:"file"`
+	Services  []string `json:"services"`
+}
+
+type ComposeServiceStatus struct {
+	Service     string `json:"service"`
+	ContainerId string `json:"containerId"`
+	Name        string `json:"name"`
+	Image       string `json:"image"`
+	State       string `json:"state"` // created, restarting, running, removing, paused, exited, dead
+	Status      string `json:"status"`
+}
+
+type ComposeResult struct {
+	Command  string                 `json:"command"`
+	Success  bool                   `json:"success"`
+	Code     int                    `json:"code"`
+	Error    string                 `json:"error"`
+	Errors   []string               `json:"errors"`
+	Stdout   []byte                 `json:"stdout"`
+	Stderr   []byte                 `json:"stderr"`
+	Services []ComposeServiceStatus `json:"services"`
+}
+
+// detectComposeCommand finds out whether the host has docker compose v2 plugin or the standalone docker-compose v1
+func (conn *SshConnection) detectComposeCommand(ctx context.Context) (string, error) {
+	err := conn.composeInit.Do(func() error {
+		childCtx, span := composeTracer.Start(ctx, "Detecting compose command")
+		defer span.End()
+
+		for _, command := range []string{"docker compose", "docker-compose"} {
+			res, err := conn.RunCommand(childCtx, command+" version --short")
+			if err != nil {
+				span.RecordError(err)
+				return err
+			}
+
+			if res.Code == 0 && res.Error == "" {
+				log.Printf("Using '%s' %s on %s", command, strings.TrimSpace(string(res.Stdout)), conn.id)
+				conn.composeCommand = command
+				return nil
+			}
+		}
+
+		err := fmt.Errorf("neither docker compose nor docker-compose is available")
+		span.RecordError(err)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return conn.composeCommand, nil
+}
+
+func (conn *SshConnection) composeCommandLine(ctx context.Context, project *ComposeProject, args ...string) (string, error) {
+	command, err := conn.detectComposeCommand(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	file := project.File
+	if file == "" {
+		file = path.Join(project.Directory, "docker-compose.yml")
+	}
+
+	parts := []string{
+		command,
+		"--project-directory", shellQuote(project.Directory),
+		"--project-name", shellQuote(project.Project),
+		"--file", shellQuote(file),
+	}
+	parts = append(parts, args...)
+	for _, service := range project.Services {
+		parts = append(parts, shellQuote(service))
+	}
+
+	return strings.Join(parts, " "), nil
+}
+
+// composeProjectNamePattern matches what compose strips from project names, after lowercasing them
+var composeProjectNamePattern = regexp.MustCompile("[^-_a-z0-9]")
+
+// normalizeComposeProjectName returns the name compose labels the containers of project with
+func normalizeComposeProjectName(project string) string {
+	return composeProjectNamePattern.ReplaceAllString(strings.ToLower(project), "")
+}
+
+func (conn *SshConnection) composeServices(ctx context.Context, project string) ([]ComposeServiceStatus, error) {
+	containers, err := conn.dockerClient.ContainerList(ctx, types.ContainerListOptions{
+		All: true,
+		Filters: filters.NewArgs(
+			filters.Arg("label", fmt.Sprintf("com.docker.compose.project=%s", normalizeComposeProjectName(project))),
+		),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	services := make([]ComposeServiceStatus, 0, len(containers))
+	for _, container := range containers {
+		name := ""
+		if len(container.Names) > 0 {
+			name = strings.TrimPrefix(container.Names[0], "/")
+		}
+
+		services = append(services, ComposeServiceStatus{
+			Service:     container.Labels["com.docker.compose.service"],
+			ContainerId: container.ID,
+			Name:        name,
+			Image:       container.Image,
+			State:       container.State,
+			Status:      container.Status,
+		})
+	}
+
+	return services, nil
+}
+
+func (conn *SshConnection) runCompose(ctx context.Context, project *ComposeProject, timeout time.Duration, args ...string) (*ComposeResult, error) {
+	childCtx, span := composeTracer.Start(ctx, fmt.Sprintf("Compose %s %s", project.Project, strings.Join(args, " ")))
+	defer span.End()
+
+	cmd, err := conn.composeCommandLine(childCtx, project, args...)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	res, err := conn.RunCommandWithTimeout(childCtx, cmd, timeout)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	result := ComposeResult{
+		Command: cmd,
+		Success: res.Code == 0 && res.Error == "",
+		Code:    res.Code,
+		Error:   res.Error,
+		Errors:  make([]string, 0),
+		Stdout:  res.Stdout,
+		Stderr:  res.Stderr,
+	}
+
+	// Compose writes progress to stderr as well, so only lines that look like errors are picked out
+	for _, line := range strings.Split(string(res.Stderr), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "ERROR") || strings.HasPrefix(line, "Error") || strings.HasPrefix(line, "error") {
+			result.Errors = append(result.Errors, line)
+		}
+	}
+
+	result.Services, err = conn.composeServices(childCtx, project.Project)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// normalizeYaml converts decoded yaml into a structure that can be serialized as JSON
+func normalizeYaml(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeYaml(item)
+		}
+		return v
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			out[fmt.Sprintf("%v", key)] = normalizeYaml(item)
+		}
+		return out
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeYaml(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func readComposeProject(ctx iris.Context) (*ComposeProject, bool) {
+	project := ComposeProject{}
+
+	if ctx.Method() == iris.MethodGet {
+		project.Directory = ctx.URLParam("directory")
+		project.File = ctx.URLParam("file")
+		project.Services = ctx.URLParamSlice("service")
+	} else if err := ctx.ReadBody(&project); err != nil {
+		ctx.StopWithError(iris.StatusBadRequest, err)
+		return nil, false
+	}
+
+	project.Project = ctx.Params().Get("project")
+
+	if project.Directory == "" {
+		ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+			Title("Missing project directory").
+			Type("compose_directory").
+			Detail("directory is required"))
+		return nil, false
+	}
+
+	return &project, true
+}
+
+func composeActionRoute(app *iris.Application, action string, args ...string) {
+	app.Post(fmt.Sprintf("/compose/:project/%s", action), func(ctx iris.Context) {
+		project, ok := readComposeProject(ctx)
+		if !ok {
+			return
+		}
+
+		timeout, ok := readCommandTimeout(ctx, defaultComposeTimeout)
+		if !ok {
+			return
+		}
+
+		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
+			return
+		}
+		defer handle.Close()
+
+		result, err := handle.conn.runCompose(ctx.Request().Context(), project, timeout, args...)
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title(fmt.Sprintf("Compose %s failed", action)).
+				Type("compose_err").
+				DetailErr(err)))
+			return
+		}
+
+		ctx.JSON(result)
+	}).SetName(fmt.Sprintf("Compose %s", action))
+}
+
+func composeUpRoute(app *iris.Application) {
+	composeActionRoute(app, "up", "up", "-d", "--remove-orphans")
+}
+
+func composeDownRoute(app *iris.Application) {
+	composeActionRoute(app, "down", "down", "--remove-orphans")
+}
+
+func composeRestartRoute(app *iris.Application) {
+	composeActionRoute(app, "restart", "restart")
+}
+
+func composePullRoute(app *iris.Application) {
+	composeActionRoute(app, "pull", "pull")
+}
+
+func composePsRoute(app *iris.Application) {
+	app.Get("/compose/:project/ps", func(ctx iris.Context) {
+		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
+			return
+		}
+		defer handle.Close()
+
+		services, err := handle.conn.composeServices(ctx.Request().Context(), ctx.Params().Get("project"))
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Command error").
+				Type("command_err").
+				DetailErr(err)))
+			return
+		}
+
+		ctx.JSON(services)
+	}).SetName("Compose ps")
+}
+
+func composeConfigRoute(app *iris.Application) {
+	type ComposeConfigResponse struct {
+		Config   interface{} `json:"config"`
+		Services []string    `json:"services"`
+		Raw      string      `json:"raw"`
+	}
+
+	app.Get("/compose/:project/config", func(ctx iris.Context) {
+		project, ok := readComposeProject(ctx)
+		if !ok {
+			return
+		}
+
+		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
+			return
+		}
+		defer handle.Close()
+
+		cmd, err := handle.conn.composeCommandLine(ctx.Request().Context(), project, "config")
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Compose config failed").
+				Type("compose_err").
+				DetailErr(err)))
+			return
+		}
+
+		res, err := handle.conn.RunCommand(ctx.Request().Context(), cmd)
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Compose config failed").
+				Type("compose_err").
+				DetailErr(err)))
+			return
+		} else if res.Code != 0 || res.Error != "" {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Compose config is invalid").
+				Type("compose_config_invalid").
+				DetailErr(fmt.Errorf("%s%s", res.Error, string(res.Stderr)))))
+			return
+		}
+
+		var config map[string]interface{}
+		if err := yaml.Unmarshal(res.Stdout, &config); err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Could not parse compose config").
+				Type("compose_config_invalid").
+				DetailErr(err)))
+			return
+		}
+
+		response := ComposeConfigResponse{
+			Config:   normalizeYaml(config),
+			Services: make([]string, 0),
+			Raw:      string(res.Stdout),
+		}
+
+		if services, ok := config["services"].(map[string]interface{}); ok {
+			for service := range services {
+				response.Services = append(response.Services, service)
+			}
+			sort.Strings(response.Services)
+		}
+
+		ctx.JSON(response)
+	}).SetName("Compose config")
+}
@@ -2,15 +2,24 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/kataras/iris/v12"
+	"github.com/spf13/viper"
 	"log"
+	"sort"
 	"sync"
 	"time"
 )
 
 type connectionManager struct {
 	connectionDeduplicationMutex sync.Map
-	connections                  map[SshConnectionCredentials]*connectionWrapper
+	connections                  map[string]*connectionWrapper
 	mu                           sync.Mutex
+	// hostSessions holds a slot for every open SSH session per host, see acquireHostSession
+	hostSessions map[string]chan struct{}
+	// hostStreams holds a slot for every long-lived session per host, see acquireHostStream
+	hostStreams map[string]chan struct{}
 }
 
 type ConnectionHandle struct {
@@ -19,34 +28,76 @@ type ConnectionHandle struct {
 }
 
 type connectionWrapper struct {
-	conn    *SshConnection
-	handles int
-	lastUse time.Time
-	marked  bool
+	// id is a random identifier for the admin API, the pool key is derived from the credentials and is never exposed
+	id        string
+	conn      *SshConnection
+	handles   int
+	lastUse   time.Time
+	createdAt time.Time
+	marked    bool
+	bastion   bool
+	host      string
+	username  string
 }
 
-var manager connectionManager
+// PooledConnection describes a pooled connection for the admin API
+type PooledConnection struct {
+	ID         string    `json:"id"`
+	Host       string    `json:"host"`
+	Username   string    `json:"username"`
+	Bastion    bool      `json:"bastion"`
+	Handles    int       `json:"handles"`
+	LastUse    time.Time `json:"lastUse"`
+	CreatedAt  time.Time `json:"createdAt"`
+	Age        float64   `json:"age"` // seconds since the connection was established
+	Lost       bool      `json:"lost"`
+	Sessions   int       `json:"sessions"`   // open command sessions including the overflow connection
+	Subsystems []string  `json:"subsystems"` // sftp, docker, docker_state, systemd, systemd_events, overflow
+}
+
+var manager = connectionManager{
+	connections:                  make(map[string]*connectionWrapper),
+	connectionDeduplicationMutex: sync.Map{},
+	hostSessions:                 make(map[string]chan struct{}),
+	hostStreams:                  make(map[string]chan struct{}),
+}
+
+const defaultIdleTimeout = 10 * time.Minute
+const defaultSweepInterval = 1 * time.Second
 
-const closeConnectionAfter = 10 * time.Minute
+// RunConnectionManager closes connections that were idle for IDLE_TIMEOUT, checking every SWEEP_INTERVAL
+func RunConnectionManager(ctx context.Context) {
+	idleTimeout := viper.GetDuration("IDLE_TIMEOUT")
+	if idleTimeout <= 0 {
+		// An unparsable value also reads as zero, which would close every connection on the second sweep
+		log.Printf("Ignoring IDLE_TIMEOUT %q because it is not a positive duration, using %s", viper.GetString("IDLE_TIMEOUT"), defaultIdleTimeout)
+		idleTimeout = defaultIdleTimeout
+	}
 
-func RunConnectionManager() {
-	manager = connectionManager{
-		connections:                  make(map[SshConnectionCredentials]*connectionWrapper),
-		connectionDeduplicationMutex: sync.Map{},
+	sweepInterval := viper.GetDuration("SWEEP_INTERVAL")
+	if sweepInterval <= 0 {
+		// An unparsable value also reads as zero, which would turn the sweeper into a busy loop
+		log.Printf("Ignoring SWEEP_INTERVAL %q because it is not a positive duration, using %s", viper.GetString("SWEEP_INTERVAL"), defaultSweepInterval)
+		sweepInterval = defaultSweepInterval
 	}
 
 	for {
-		time.Sleep(1 * time.Second)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(sweepInterval):
+		}
 
 		// mark and sweep garbage collection
+		var unused []*connectionWrapper
 		manager.mu.Lock()
 		for key, element := range manager.connections {
 			if element.handles == 0 {
-				if element.marked && time.Now().After(element.lastUse.Add(closeConnectionAfter)) {
+				if element.marked && time.Now().After(element.lastUse.Add(idleTimeout)) {
 					log.Printf("Closing connection %s because it was not used recently", element.conn.id)
 					delete(manager.connections, key)
 
-					element.conn.Close()
+					unused = append(unused, element)
 				} else {
 					element.marked = true
 				}
@@ -55,11 +106,286 @@ func RunConnectionManager() {
 			}
 		}
 		manager.mu.Unlock()
+
+		// Connections are closed outside of the lock because closing a tunnelled connection releases its jump host handle
+		for _, element := range unused {
+			element.conn.Close()
+		}
+	}
+}
+
+// CloseAllConnections closes every pooled connection regardless of open handles, used on shutdown
+func CloseAllConnections() {
+	manager.mu.Lock()
+	elements := make([]*connectionWrapper, 0, len(manager.connections))
+	for key, element := range manager.connections {
+		log.Printf("Closing connection %s because of shutdown", element.conn.id)
+		delete(manager.connections, key)
+
+		elements = append(elements, element)
+	}
+	manager.mu.Unlock()
+
+	for _, element := range elements {
+		if err := element.conn.Close(); err != nil {
+			log.Printf("Failed to close connection %s because %s", element.conn.id, err)
+		}
+	}
+}
+
+func (element *connectionWrapper) describe() PooledConnection {
+	return PooledConnection{
+		ID:         element.id,
+		Host:       element.host,
+		Username:   element.username,
+		Bastion:    element.bastion,
+		Handles:    element.handles,
+		LastUse:    element.lastUse,
+		CreatedAt:  element.createdAt,
+		Age:        time.Since(element.createdAt).Seconds(),
+		Lost:       element.conn.isLost(),
+		Sessions:   element.conn.openSessions(),
+		Subsystems: element.conn.subsystems(),
+	}
+}
+
+// ListPooledConnections returns all connections held by the connection manager ordered by host
+func ListPooledConnections() []PooledConnection {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	connections := make([]PooledConnection, 0, len(manager.connections))
+	for _, element := range manager.connections {
+		connections = append(connections, element.describe())
+	}
+
+	sort.Slice(connections, func(i, j int) bool {
+		if connections[i].Host != connections[j].Host {
+			return connections[i].Host < connections[j].Host
+		}
+		return connections[i].ID < connections[j].ID
+	})
+
+	return connections
+}
+
+// findPooledConnection returns the pool key and connection with the given admin id, manager.mu has to be held
+func (manager *connectionManager) findPooledConnection(id string) (string, *connectionWrapper) {
+	for key, element := range manager.connections {
+		if element.id == id {
+			return key, element
+		}
+	}
+
+	return "", nil
+}
+
+// DescribePooledConnection returns the pooled connection with the given id
+func DescribePooledConnection(id string) (PooledConnection, bool) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	_, element := manager.findPooledConnection(id)
+	if element == nil {
+		return PooledConnection{}, false
+	}
+
+	return element.describe(), true
+}
+
+// describePooledConnectionForKey returns the pooled connection stored under the pool key
+func describePooledConnectionForKey(key string) (PooledConnection, bool) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	element := manager.connections[key]
+	if element == nil {
+		return PooledConnection{}, false
+	}
+
+	return element.describe(), true
+}
+
+// ClosePooledConnection removes the connection with the given id from the pool and closes it even if it still has
+// open handles, requests using it fail with connection_lost
+func ClosePooledConnection(id string) bool {
+	manager.mu.Lock()
+	key, element := manager.findPooledConnection(id)
+	if element != nil {
+		delete(manager.connections, key)
+	}
+	manager.mu.Unlock()
+
+	return closeRemovedConnection(element)
+}
+
+// closePooledConnectionForKey is ClosePooledConnection for the connection stored under the pool key
+func closePooledConnectionForKey(key string) bool {
+	manager.mu.Lock()
+	element := manager.connections[key]
+	if element != nil {
+		delete(manager.connections, key)
+	}
+	manager.mu.Unlock()
+
+	return closeRemovedConnection(element)
+}
+
+func closeRemovedConnection(element *connectionWrapper) bool {
+	if element == nil {
+		return false
+	}
+
+	log.Printf("Closing connection %s on request", element.conn.id)
+	if err := element.conn.Close(); err != nil {
+		log.Printf("Failed to close connection %s because %s", element.conn.id, err)
 	}
+
+	return true
+}
+
+// evictIdleConnections makes room for a new connection when MAX_CONNECTIONS is reached by closing the least recently
+// used connections without open handles. Connections that are in use are never evicted, so the cap can be exceeded
+// while all of them are busy.
+func evictIdleConnections() {
+	maxConnections := viper.GetInt("MAX_CONNECTIONS")
+	if maxConnections <= 0 {
+		return
+	}
+
+	var evicted []*connectionWrapper
+	manager.mu.Lock()
+	for len(manager.connections) >= maxConnections {
+		var lruKey string
+		var lru *connectionWrapper
+		for key, element := range manager.connections {
+			if element.handles == 0 && (lru == nil || element.lastUse.Before(lru.lastUse)) {
+				lruKey, lru = key, element
+			}
+		}
+
+		if lru == nil {
+			log.Printf("Connection limit of %d exceeded because all connections are in use", maxConnections)
+			break
+		}
+
+		log.Printf("Closing connection %s to stay within the connection limit", lru.conn.id)
+		delete(manager.connections, lruKey)
+		evicted = append(evicted, lru)
+	}
+	manager.mu.Unlock()
+
+	for _, element := range evicted {
+		element.conn.Close()
+	}
+}
+
+// acquireHostSession waits until fewer than HOST_MAX_SESSIONS sessions are open to host and takes a slot,
+// release must be called once the session is closed
+func acquireHostSession(ctx context.Context, host string) (release func(), err error) {
+	manager.mu.Lock()
+	slots, ok := manager.hostSessions[host]
+	if !ok {
+		limit := viper.GetInt("HOST_MAX_SESSIONS")
+		if limit < 1 {
+			limit = 1
+		}
+
+		slots = make(chan struct{}, limit)
+		manager.hostSessions[host] = slots
+	}
+	manager.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+	default:
+		log.Printf("Waiting for a free session on %s", host)
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	var releaseOnce sync.Once
+	return func() {
+		releaseOnce.Do(func() {
+			<-slots
+		})
+	}, nil
+}
+
+// acquireHostStream takes one of the slots of host that long-lived sessions may hold, it does not wait because a
+// stream can take arbitrarily long to give its slot back. The session itself still needs a slot from acquireHostSession.
+func acquireHostStream(host string) (release func(), err error) {
+	manager.mu.Lock()
+	slots, ok := manager.hostStreams[host]
+	if !ok {
+		slots = make(chan struct{}, streamLimit(viper.GetInt("HOST_MAX_SESSIONS")))
+		manager.hostStreams[host] = slots
+	}
+	manager.mu.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+	default:
+		return nil, fmt.Errorf("%w to %s", ErrTooManyStreams, host)
+	}
+
+	var releaseOnce sync.Once
+	return func() {
+		releaseOnce.Do(func() {
+			<-slots
+		})
+	}, nil
+}
+
+// evictWhenLost removes the connection from the pool as soon as it is lost instead of waiting for the next request
+func evictWhenLost(key string, element *connectionWrapper) {
+	<-element.conn.lost
+
+	manager.mu.Lock()
+	evicted := manager.connections[key] == element
+	if evicted {
+		delete(manager.connections, key)
+	}
+	manager.mu.Unlock()
+
+	if evicted {
+		log.Printf("Evicting connection %s because %s", element.conn.id, element.conn.lostErr)
+		element.conn.Close()
+	}
+}
+
+// problem replaces problem with connection_lost when the connection died while the request was using it
+func (handle *ConnectionHandle) problem(problem iris.Problem) iris.Problem {
+	if !handle.conn.isLost() {
+		return problem
+	}
+
+	return iris.NewProblem().
+		Title("Connection to target host lost").
+		Status(iris.StatusBadRequest).
+		Type("connection_lost").
+		DetailErr(handle.conn.lostErr)
 }
 
 func GetConnection(ctx context.Context, args *SshConnectionCredentials) (*ConnectionHandle, error) {
-	dedupe, _ := manager.connectionDeduplicationMutex.LoadOrStore(*args, &sync.Mutex{})
+	return getPooledConnection(ctx, args, false)
+}
+
+// GetBastionConnection returns a pooled connection used only for tunnelling, shared by all hosts behind the bastion
+func GetBastionConnection(ctx context.Context, args *SshConnectionCredentials) (*ConnectionHandle, error) {
+	return getPooledConnection(ctx, args, true)
+}
+
+func getPooledConnection(ctx context.Context, args *SshConnectionCredentials, bastion bool) (*ConnectionHandle, error) {
+	key := args.key()
+	if bastion {
+		key = "bastion:" + key
+	}
+
+	dedupe, _ := manager.connectionDeduplicationMutex.LoadOrStore(key, &sync.Mutex{})
 
 	_, span := sshTracer.Start(ctx, "Awaiting connection lock")
 	dedupe.(*sync.Mutex).Lock()
@@ -67,24 +393,50 @@ func GetConnection(ctx context.Context, args *SshConnectionCredentials) (*Connec
 	span.End()
 
 	manager.mu.Lock()
-	conn := manager.connections[*args]
+	conn := manager.connections[key]
+
+	// Dead connections are evicted here so that the request transparently gets a fresh one
+	if conn != nil && conn.conn.isLost() {
+		log.Printf("Reconnecting to %s because %s", conn.conn.id, conn.conn.lostErr)
+		delete(manager.connections, key)
+		go conn.conn.Close()
+		conn = nil
+	}
 
 	if conn == nil {
 		manager.mu.Unlock()
-		host, err := ConnectToHost(ctx, args)
+		evictIdleConnections()
+
+		connect := ConnectToHost
+		if bastion {
+			connect = ConnectToBastion
+		}
+
+		connectStart := time.Now()
+		host, err := connect(ctx, args)
+		sshConnectDuration.Observe(time.Since(connectStart).Seconds())
 		if err != nil {
+			sshConnectFailures.Inc()
 			return nil, err
 		}
 
 		manager.mu.Lock()
-		conn = manager.connections[*args]
+		conn = manager.connections[key]
 		if conn == nil {
 			conn = &connectionWrapper{
-				conn:    host,
-				handles: 0,
+				id:        uuid.New().String(),
+				conn:      host,
+				handles:   0,
+				createdAt: time.Now(),
+				bastion:   bastion,
+				host:      args.Host,
+				username:  args.Username,
 			}
 
-			manager.connections[*args] = conn
+			manager.connections[key] = conn
+
+			go host.watchConnection(viper.GetDuration("KEEPALIVE_INTERVAL"), viper.GetInt("KEEPALIVE_MAX_MISSED"))
+			go evictWhenLost(key, conn)
 		}
 	}
 
@@ -92,12 +444,19 @@ func GetConnection(ctx context.Context, args *SshConnectionCredentials) (*Connec
 	conn.handles += 1
 	manager.mu.Unlock()
 
+	// Close is idempotent so that a handle released on an error path and again by a deferred Close is only counted once
+	var closeOnce sync.Once
 	handle := ConnectionHandle{
 		conn: conn.conn,
 		Close: func() {
-			conn.handles -= 1
-			conn.lastUse = time.Now()
-			log.Printf("Closed connection handle to %s", conn.conn.id)
+			closeOnce.Do(func() {
+				manager.mu.Lock()
+				conn.handles -= 1
+				conn.lastUse = time.Now()
+				manager.mu.Unlock()
+
+				log.Printf("Closed connection handle to %s", conn.conn.id)
+			})
 		},
 	}
 
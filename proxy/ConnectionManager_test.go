@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"github.com/pkg/sftp"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testServer is an in-process SSH server with just enough of a host for ConnectToHost: a shell, sftp and exec of
+// "id -u". Docker is not served, the docker state started after connecting fails and is retried on first use.
+type testServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  string
+	// accepted counts the SSH connections that finished the handshake
+	accepted int32
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func startTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate host key: %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatalf("failed to create host key signer: %s", err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if meta.User() == "test" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	server := &testServer{
+		listener: listener,
+		config:   config,
+		hostKey:  string(ssh.MarshalAuthorizedKey(signer.PublicKey())),
+	}
+	go server.serve()
+
+	t.Cleanup(func() {
+		CloseAllConnections()
+		listener.Close()
+		server.dropConnections()
+	})
+
+	return server
+}
+
+func (server *testServer) credentials() *SshConnectionCredentials {
+	return &SshConnectionCredentials{
+		Host:     server.listener.Addr().String(),
+		Username: "test",
+		Password: "secret",
+		HostKey:  server.hostKey,
+	}
+}
+
+// dropConnections cuts every connection from the server side, like a host that went away
+func (server *testServer) dropConnections() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	for _, conn := range server.conns {
+		conn.Close()
+	}
+	server.conns = nil
+}
+
+func (server *testServer) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		server.mu.Lock()
+		server.conns = append(server.conns, conn)
+		server.mu.Unlock()
+
+		go server.handle(conn)
+	}
+}
+
+func (server *testServer) handle(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, server.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	atomic.AddInt32(&server.accepted, 1)
+
+	// Keepalives are answered with a rejection, which still counts as an answer
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go serveSession(channel, requests)
+	}
+}
+
+func serveSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for request := range requests {
+		switch request.Type {
+		case "shell":
+			request.Reply(true, nil)
+			go io.Copy(ioutil.Discard, channel)
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(request.Payload, &payload); err != nil {
+				request.Reply(false, nil)
+				continue
+			}
+			request.Reply(true, nil)
+
+			if payload.Command == "id -u" {
+				channel.Write([]byte("1000\n"))
+			}
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+			return
+		case "subsystem":
+			var payload struct{ Name string }
+			if err := ssh.Unmarshal(request.Payload, &payload); err != nil || payload.Name != "sftp" {
+				request.Reply(false, nil)
+				continue
+			}
+			request.Reply(true, nil)
+
+			sftpServer, err := sftp.NewServer(channel)
+			if err != nil {
+				return
+			}
+			go func() {
+				sftpServer.Serve()
+				sftpServer.Close()
+			}()
+		default:
+			request.Reply(request.WantReply, nil)
+		}
+	}
+}
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+
+	// The test server key is pinned in the credentials, so the known hosts store is never written
+	viper.Set("HOST_KEY_MODE", HostKeyModeStrict)
+	viper.Set("KEEPALIVE_INTERVAL", 50*time.Millisecond)
+	viper.Set("KEEPALIVE_MAX_MISSED", 3)
+	viper.Set("MAX_CONNECTIONS", 100)
+	viper.Set("CONNECTION_MAX_SESSIONS", 8)
+	viper.Set("HOST_MAX_SESSIONS", 16)
+	viper.Set("RESERVED_COMMAND_SESSIONS", 2)
+	viper.Set("OVERFLOW_QUEUE_LENGTH", 0)
+
+	os.Exit(m.Run())
+}
+
+// hammer runs f from workers goroutines iterations times each and waits for all of them
+func hammer(workers int, iterations int, f func(worker int, iteration int)) {
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for iteration := 0; iteration < iterations; iteration++ {
+				f(worker, iteration)
+			}
+		}(worker)
+	}
+	wg.Wait()
+}
+
+func pooledHandles(t *testing.T, key string) int {
+	t.Helper()
+
+	connection, ok := describePooledConnectionForKey(key)
+	if !ok {
+		t.Fatalf("connection %s is not pooled", key)
+	}
+
+	return connection.Handles
+}
+
+func TestGetConnectionConcurrently(t *testing.T) {
+	server := startTestServer(t)
+	credentials := server.credentials()
+
+	hammer(32, 20, func(worker int, iteration int) {
+		handle, err := GetConnection(context.Background(), credentials)
+		if err != nil {
+			t.Errorf("GetConnection failed: %s", err)
+			return
+		}
+
+		if iteration%5 == 0 {
+			if _, err := handle.conn.RunCommand(context.Background(), "true"); err != nil {
+				t.Errorf("RunCommand failed: %s", err)
+			}
+		}
+
+		// Closing twice has to release the handle only once
+		handle.Close()
+		handle.Close()
+	})
+
+	if accepted := atomic.LoadInt32(&server.accepted); accepted != 1 {
+		t.Errorf("expected concurrent requests to share one connection, the server accepted %d", accepted)
+	}
+	if handles := pooledHandles(t, credentials.key()); handles != 0 {
+		t.Errorf("expected all handles to be released, %d are still open", handles)
+	}
+}
+
+func TestConcurrentHandleClose(t *testing.T) {
+	server := startTestServer(t)
+	credentials := server.credentials()
+
+	hammer(16, 20, func(worker int, iteration int) {
+		handle, err := GetConnection(context.Background(), credentials)
+		if err != nil {
+			t.Errorf("GetConnection failed: %s", err)
+			return
+		}
+
+		// An error path and a deferred Close racing each other
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				handle.Close()
+			}()
+		}
+		wg.Wait()
+	})
+
+	if handles := pooledHandles(t, credentials.key()); handles != 0 {
+		t.Errorf("expected all handles to be released, %d are still open", handles)
+	}
+}
+
+func TestClosePooledConnectionWhileInUse(t *testing.T) {
+	server := startTestServer(t)
+	credentials := server.credentials()
+	key := credentials.key()
+
+	done := make(chan struct{})
+	var closed int32
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+
+			// The admin API only knows the connection id, which changes whenever the connection is replaced
+			if connection, ok := describePooledConnectionForKey(key); ok && ClosePooledConnection(connection.ID) {
+				atomic.AddInt32(&closed, 1)
+			}
+			ListPooledConnections()
+		}
+	}()
+
+	hammer(16, 20, func(worker int, iteration int) {
+		handle, err := GetConnection(context.Background(), credentials)
+		if err != nil {
+			t.Errorf("GetConnection failed: %s", err)
+			return
+		}
+		defer handle.Close()
+
+		// The connection may be closed underneath the request, which then fails but must not panic
+		if _, err := handle.conn.RunCommand(context.Background(), "true"); err != nil && !handle.conn.isLost() {
+			t.Errorf("RunCommand failed on a live connection: %s", err)
+		}
+	})
+	close(done)
+
+	if atomic.LoadInt32(&closed) == 0 {
+		t.Fatalf("expected the admin close to hit a pooled connection at least once")
+	}
+
+	handle, err := GetConnection(context.Background(), credentials)
+	if err != nil {
+		t.Fatalf("GetConnection after admin close failed: %s", err)
+	}
+	if handle.conn.isLost() {
+		t.Errorf("expected a fresh connection after admin close")
+	}
+	handle.Close()
+
+	if handles := pooledHandles(t, key); handles != 0 {
+		t.Errorf("expected all handles to be released, %d are still open", handles)
+	}
+}
+
+func TestLostConnectionIsEvicted(t *testing.T) {
+	server := startTestServer(t)
+	credentials := server.credentials()
+	key := credentials.key()
+
+	handle, err := GetConnection(context.Background(), credentials)
+	if err != nil {
+		t.Fatalf("GetConnection failed: %s", err)
+	}
+	lost := handle.conn
+
+	server.dropConnections()
+
+	select {
+	case <-lost.lost:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection was not marked lost after the server dropped it")
+	}
+
+	// Requests racing the eviction either reconnect or find the fresh connection
+	hammer(16, 10, func(worker int, iteration int) {
+		handle, err := GetConnection(context.Background(), credentials)
+		if err != nil {
+			t.Errorf("GetConnection after connection loss failed: %s", err)
+			return
+		}
+		defer handle.Close()
+
+		if handle.conn == lost {
+			t.Errorf("GetConnection returned the lost connection")
+		}
+	})
+
+	// The handle on the lost connection is still released normally
+	handle.Close()
+
+	manager.mu.Lock()
+	element := manager.connections[key]
+	manager.mu.Unlock()
+	if element == nil || element.conn == lost {
+		t.Fatalf("expected the lost connection to be replaced in the pool")
+	}
+	if handles := pooledHandles(t, key); handles != 0 {
+		t.Errorf("expected all handles to be released, %d are still open", handles)
+	}
+}
+
+func TestLazyInitRetriesAfterFailure(t *testing.T) {
+	var lazy lazyInit
+	var attempts int32
+
+	hammer(32, 10, func(worker int, iteration int) {
+		lazy.Do(func() error {
+			// The first attempt fails, every later caller has to see the successful second one
+			if atomic.AddInt32(&attempts, 1) == 1 {
+				return errors.New("first attempt fails")
+			}
+			return nil
+		})
+	})
+
+	if !lazy.initialized() {
+		t.Fatalf("expected lazyInit to be initialized after a successful attempt")
+	}
+	if attempts := atomic.LoadInt32(&attempts); attempts != 2 {
+		t.Errorf("expected exactly one retry after the failure, got %d attempts", attempts)
+	}
+}
+
+func TestLostOverflowIsReopened(t *testing.T) {
+	server := startTestServer(t)
+
+	handle, err := GetConnection(context.Background(), server.credentials())
+	if err != nil {
+		t.Fatalf("GetConnection failed: %s", err)
+	}
+	defer handle.Close()
+	conn := handle.conn
+
+	if err := conn.openOverflow(context.Background()); err != nil {
+		t.Fatalf("failed to open overflow connection: %s", err)
+	}
+	lost := conn.currentOverflow()
+
+	// The overflow client going away must not leave a dead client behind for later sessions
+	lost.client.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for conn.currentOverflow() != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("lost overflow connection was not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := conn.openOverflow(context.Background()); err != nil {
+		t.Fatalf("failed to reopen overflow connection: %s", err)
+	}
+	if overflow := conn.currentOverflow(); overflow == nil || overflow == lost {
+		t.Fatalf("expected a fresh overflow connection")
+	}
+
+	session, err := conn.newSession(context.Background())
+	if err != nil {
+		t.Fatalf("failed to open a session after reopening the overflow connection: %s", err)
+	}
+	session.Close()
+}
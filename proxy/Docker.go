@@ -2,23 +2,36 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/filters"
 	dockerClient "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/kataras/iris/v12"
 	"github.com/kataras/iris/v12/middleware/jwt"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 	"golang.org/x/crypto/ssh"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 var dockerTracer = otel.Tracer("Docker")
 
+const defaultContainerLogLines = 1000
+const maxContainerLogLines = 100000
+
+// maxContainerLogLineSize is where a line without a newline is cut, so that a stream without newlines is not buffered
+const maxContainerLogLineSize = 1024 * 1024
+
 func createDockerClient(sshClient *ssh.Client) (*dockerClient.Client, error) {
 	transport := &http.Transport{
 		DialContext: func(ctx context.Context, net string, addr string) (net.Conn, error) {
@@ -43,10 +56,7 @@ func containerInspectRoute(app *iris.Application) {
 	app.Get("/docker/containers/:id/json", func(ctx iris.Context) {
 		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
 		if err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
-				Title("Connection to target host failed").
-				Type("connection_err").
-				DetailErr(err))
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
 			return
 		}
 		defer handle.Close()
@@ -54,10 +64,10 @@ func containerInspectRoute(app *iris.Application) {
 		log.Printf("Inspecting container %s", ctx.Params().Get("id"))
 		containers, _, err := handle.conn.dockerClient.ContainerInspectWithRaw(ctx.Request().Context(), ctx.Params().Get("id"), true)
 		if err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
 				Title("Command error").
 				Type("command_err").
-				DetailErr(err))
+				DetailErr(err)))
 			return
 		}
 
@@ -69,10 +79,7 @@ func containersRoute(app *iris.Application) {
 	app.Get("/docker/containers/json", func(ctx iris.Context) {
 		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
 		if err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
-				Title("Connection to target host failed").
-				Type("connection_err").
-				DetailErr(err))
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
 			return
 		}
 		defer handle.Close()
@@ -85,10 +92,10 @@ func containersRoute(app *iris.Application) {
 			Size:    true,
 		})
 		if err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
 				Title("Command error").
 				Type("command_err").
-				DetailErr(err))
+				DetailErr(err)))
 			return
 		}
 
@@ -100,10 +107,7 @@ func containerStatsRoute(app *iris.Application) {
 	app.Get("/docker/containers/:id/stats", func(ctx iris.Context) {
 		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
 		if err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
-				Title("Connection to target host failed").
-				Type("connection_err").
-				DetailErr(err))
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
 			return
 		}
 		defer handle.Close()
@@ -111,10 +115,10 @@ func containerStatsRoute(app *iris.Application) {
 		log.Printf("Reading container stats for %s", ctx.Params().Get("id"))
 		statStream, err := handle.conn.dockerClient.ContainerStats(ctx.Request().Context(), ctx.Params().Get("id"), true)
 		if err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
 				Title("Command error").
 				Type("command_err").
-				DetailErr(err))
+				DetailErr(err)))
 			return
 		}
 		defer statStream.Body.Close()
@@ -126,22 +130,22 @@ func containerStatsRoute(app *iris.Application) {
 			for {
 				line, _, err := reader.ReadLine()
 				if err != nil {
-					ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+					ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
 						Title("Command error").
 						Detail("Error reading stats").
 						Type("command_err").
-						DetailErr(err))
+						DetailErr(err)))
 					return
 				}
 
 				var stats types.Stats
 				err = json.Unmarshal(line, &stats)
 				if err != nil {
-					ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+					ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
 						Title("Command error").
 						Detail("Error parsing stats").
 						Type("command_err").
-						DetailErr(err))
+						DetailErr(err)))
 					return
 				}
 
@@ -159,10 +163,7 @@ func dockerEventsRoute(app *iris.Application) {
 	app.Get("/docker/events", func(ctx iris.Context) {
 		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
 		if err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
-				Title("Connection to target host failed").
-				Type("connection_err").
-				DetailErr(err))
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
 			return
 		}
 		defer handle.Close()
@@ -201,3 +202,210 @@ func dockerEventsRoute(app *iris.Application) {
 		sse(ctx, lines)
 	}).SetName("Docker events")
 }
+
+type ContainerLogLine struct {
+	Stream    string `json:"stream"` // stdout, stderr
+	Timestamp string `json:"timestamp,omitempty"`
+	Line      string `json:"line"`
+}
+
+func parseLogLine(stream string, data []byte, timestamps bool) ContainerLogLine {
+	line := ContainerLogLine{
+		Stream: stream,
+		Line:   strings.TrimSuffix(string(data), "\n"),
+	}
+
+	if timestamps {
+		if i := strings.IndexByte(line.Line, ' '); i > 0 {
+			line.Timestamp = line.Line[:i]
+			line.Line = line.Line[i+1:]
+		}
+	}
+
+	return line
+}
+
+// readContainerLogs splits a log stream into lines, demultiplexing stdout and stderr frames unless the container has a TTY
+func readContainerLogs(reader io.Reader, tty bool, timestamps bool, emit func(line ContainerLogLine) error) error {
+	if tty {
+		lineReader := bufio.NewReader(reader)
+		for {
+			data, err := lineReader.ReadBytes('\n')
+			if len(data) > 0 {
+				if err := emit(parseLogLine("stdout", data, timestamps)); err != nil {
+					return err
+				}
+			}
+
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Frames do not follow line boundaries, a long line can span several frames and a frame can hold several lines
+	pending := map[string][]byte{}
+	flush := func(stream string, final bool) error {
+		for len(pending[stream]) > 0 {
+			end := bytes.IndexByte(pending[stream], '\n') + 1
+			if end == 0 {
+				if !final && len(pending[stream]) < maxContainerLogLineSize {
+					return nil
+				}
+				end = len(pending[stream])
+			}
+
+			line := pending[stream][:end]
+			pending[stream] = pending[stream][end:]
+			if err := emit(parseLogLine(stream, line, timestamps)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header); err == io.EOF {
+			if err := flush("stdout", true); err != nil {
+				return err
+			}
+			return flush("stderr", true)
+		} else if err != nil {
+			return fmt.Errorf("failed to read log frame header: %w", err)
+		}
+
+		stream := "stdout"
+		if stdcopy.StdType(header[0]) == stdcopy.Stderr {
+			stream = "stderr"
+		}
+
+		frame := make([]byte, binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return fmt.Errorf("failed to read log frame: %w", err)
+		}
+
+		pending[stream] = append(pending[stream], frame...)
+		if err := flush(stream, false); err != nil {
+			return err
+		}
+	}
+}
+
+func containerLogsRoute(app *iris.Application) {
+	app.Get("/docker/containers/:id/logs", func(ctx iris.Context) {
+		follow, _ := ctx.URLParamBool("follow")
+		timestamps, _ := ctx.URLParamBool("timestamps")
+
+		// Logs that are not followed are buffered into a single response, so at most maxContainerLogLines of them are
+		// kept. tail=all is accepted as docker does, but then only the last maxContainerLogLines lines are returned.
+		tail := ctx.URLParamDefault("tail", "all")
+		if !follow && tail != "all" {
+			lines := defaultContainerLogLines
+			var err error
+			if ctx.URLParamExists("tail") {
+				lines, err = strconv.Atoi(tail)
+			}
+			if err != nil || lines < 0 || lines > maxContainerLogLines {
+				ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+					Title("Invalid line limit").
+					Type("docker_logs").
+					Detail(fmt.Sprintf("tail has to be all or between 0 and %d", maxContainerLogLines)))
+				return
+			}
+			tail = strconv.Itoa(lines)
+		}
+
+		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
+			return
+		}
+		defer handle.Close()
+
+		id := ctx.Params().Get("id")
+		container, err := handle.conn.dockerClient.ContainerInspect(ctx.Request().Context(), id)
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Command error").
+				Type("command_err").
+				DetailErr(err)))
+			return
+		}
+
+		log.Printf("Reading container logs for %s", id)
+		logStream, err := handle.conn.dockerClient.ContainerLogs(ctx.Request().Context(), id, types.ContainerLogsOptions{
+			ShowStdout: true,
+			ShowStderr: true,
+			Since:      ctx.URLParam("since"),
+			Until:      ctx.URLParam("until"),
+			Timestamps: timestamps,
+			Follow:     follow,
+			Tail:       tail,
+		})
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Command error").
+				Type("command_err").
+				DetailErr(err)))
+			return
+		}
+		defer logStream.Close()
+
+		if !follow {
+			logLines := make([]ContainerLogLine, 0)
+			truncated := false
+			err := readContainerLogs(logStream, container.Config.Tty, timestamps, func(line ContainerLogLine) error {
+				if len(logLines) == maxContainerLogLines {
+					logLines = logLines[1:]
+					truncated = true
+				}
+				logLines = append(logLines, line)
+				return nil
+			})
+			if err != nil {
+				ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+					Title("Command error").
+					Detail("Error reading logs").
+					Type("command_err").
+					DetailErr(err)))
+				return
+			}
+
+			if truncated {
+				ctx.Header("X-Logs-Truncated", "true")
+			}
+			ctx.JSON(logLines)
+			return
+		}
+
+		lines := make(chan string)
+		go (func() {
+			defer close(lines)
+
+			err := readContainerLogs(logStream, container.Config.Tty, timestamps, func(line ContainerLogLine) error {
+				lineOut, _ := json.Marshal(line)
+				select {
+				case lines <- string(lineOut):
+					return nil
+				case <-ctx.Request().Context().Done():
+					return ctx.Request().Context().Err()
+				}
+			})
+			if err != nil && ctx.Request().Context().Err() == nil {
+				log.Printf("Received error %v\n", err)
+				lineOut, _ := json.Marshal(iris.NewProblem().
+					Title("Error reading logs").
+					Detail("Error reading logs").
+					Type("stream_err").
+					DetailErr(err))
+				lines <- string(lineOut)
+			}
+		})()
+
+		sse(ctx, lines)
+	}).SetName("Docker container logs")
+}
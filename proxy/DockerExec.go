@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/middleware/jwt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+)
+
+// hijackExec starts the exec instance and returns the raw stream. The docker client can not hijack through our
+// transport and would dial the local socket instead, so the upgrade request is written over the tunnelled socket.
+func (conn *SshConnection) hijackExec(ctx context.Context, execId string) (net.Conn, *bufio.Reader, error) {
+	socket, err := conn.client.Dial("unix", "/var/run/docker.sock")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open docker socket: %w", err)
+	}
+
+	body, _ := json.Marshal(types.ExecStartCheck{Tty: true})
+	request, err := http.NewRequestWithContext(ctx, iris.MethodPost, fmt.Sprintf("/v%s/exec/%s/start", conn.dockerClient.ClientVersion(), execId), bytes.NewReader(body))
+	if err != nil {
+		socket.Close()
+		return nil, nil, err
+	}
+	request.Host = "docker"
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "tcp")
+
+	if err := request.Write(socket); err != nil {
+		socket.Close()
+		return nil, nil, fmt.Errorf("failed to start exec: %w", err)
+	}
+
+	reader := bufio.NewReader(socket)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		socket.Close()
+		return nil, nil, fmt.Errorf("failed to start exec: %w", err)
+	}
+
+	if response.StatusCode != http.StatusSwitchingProtocols && response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(response.Body)
+		socket.Close()
+		return nil, nil, fmt.Errorf("failed to start exec: %s %s", response.Status, bytes.TrimSpace(message))
+	}
+
+	return socket, reader, nil
+}
+
+func containerExecRoute(app *iris.Application) {
+	app.Get("/docker/containers/:id/exec", func(ctx iris.Context) {
+		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
+			return
+		}
+		defer handle.Close()
+
+		id := ctx.Params().Get("id")
+		cmd := ctx.URLParamSlice("cmd")
+		if len(cmd) == 0 {
+			cmd = []string{"/bin/sh"}
+		}
+
+		log.Printf("Creating exec %v in container %s", cmd, id)
+		exec, err := handle.conn.dockerClient.ContainerExecCreate(ctx.Request().Context(), id, types.ExecConfig{
+			User:         ctx.URLParam("user"),
+			WorkingDir:   ctx.URLParam("workdir"),
+			Env:          ctx.URLParamSlice("env"),
+			Cmd:          cmd,
+			Tty:          true,
+			AttachStdin:  true,
+			AttachStdout: true,
+			AttachStderr: true,
+		})
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Creating exec failed").
+				Type("docker_exec_err").
+				DetailErr(err)))
+			return
+		}
+
+		// The exec is started before the upgrade so that failures can still be reported as a problem
+		stream, output, err := handle.conn.hijackExec(ctx.Request().Context(), exec.ID)
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Starting exec failed").
+				Type("docker_exec_err").
+				DetailErr(err)))
+			return
+		}
+		defer stream.Close()
+
+		socket, err := terminalUpgrader.Upgrade(ctx.ResponseWriter(), ctx.Request(), nil)
+		if err != nil {
+			log.Printf("Failed to upgrade exec %s to websocket because %s", exec.ID, err)
+			return
+		}
+		defer socket.Close()
+
+		resize := func(cols uint, rows uint) {
+			if cols == 0 || rows == 0 {
+				return
+			}
+
+			err := handle.conn.dockerClient.ContainerExecResize(context.Background(), exec.ID, types.ResizeOptions{Width: cols, Height: rows})
+			if err != nil {
+				log.Printf("Failed to resize exec %s because %s", exec.ID, err)
+			}
+		}
+		resize(uint(ctx.URLParamIntDefault("cols", 0)), uint(ctx.URLParamIntDefault("rows", 0)))
+
+		bridge := terminalBridge{
+			name:   fmt.Sprintf("exec %s", exec.ID),
+			output: output,
+			input:  stream,
+			resize: resize,
+			// Closing the stream ends the output as well
+			close: func() {
+				stream.Close()
+			},
+			exit: func() TerminalExitMessage {
+				exit := TerminalExitMessage{Type: "exit"}
+				inspect, err := handle.conn.dockerClient.ContainerExecInspect(context.Background(), exec.ID)
+				if err != nil {
+					exit.Error = err.Error()
+				} else {
+					exit.Code = inspect.ExitCode
+				}
+				return exit
+			},
+		}
+		bridge.run(socket)
+	}).SetName("Docker container exec")
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	dockerClient "github.com/docker/docker/client"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/middleware/jwt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// DockerState is an in-memory model of all compose containers on a host, kept in sync with docker events
+type DockerState struct {
+	conn        *SshConnection
+	cancel      context.CancelFunc
+	ready       chan struct{}
+	mu          sync.RWMutex
+	err         error
+	containers  map[string]types.ContainerJSON
+	document    interface{}
+	subscribers map[chan []JsonPatchOperation]struct{}
+}
+
+type DockerStateDocument struct {
+	Containers map[string]types.ContainerJSON `json:"containers"`
+}
+
+// subscriberBuffer is how many patches a slow subscriber can fall behind before it is disconnected
+const subscriberBuffer = 64
+
+var composeContainerFilters = filters.NewArgs(
+	filters.Arg("label", "com.docker.compose.project"),
+)
+
+// startDockerState starts the container state model unless it is already running, without waiting for it to be ready.
+// It is started when the connection opens so that the first snapshot does not pay for listing and inspecting.
+func (conn *SshConnection) startDockerState() *DockerState {
+	conn.dockerStateMu.Lock()
+	defer conn.dockerStateMu.Unlock()
+
+	state := conn.dockerState
+	if state == nil || state.failed() {
+		stateCtx, cancel := context.WithCancel(conn.ctx)
+		state = &DockerState{
+			conn:        conn,
+			cancel:      cancel,
+			ready:       make(chan struct{}),
+			containers:  make(map[string]types.ContainerJSON),
+			subscribers: make(map[chan []JsonPatchOperation]struct{}),
+		}
+		conn.dockerState = state
+
+		go state.run(stateCtx)
+	}
+
+	return state
+}
+
+// GetDockerState returns the container state model for this connection, restarting it if the previous one failed
+func (conn *SshConnection) GetDockerState(ctx context.Context) (*DockerState, error) {
+	state := conn.startDockerState()
+
+	select {
+	case <-state.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if err := state.Err(); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func (state *DockerState) failed() bool {
+	select {
+	case <-state.ready:
+		return state.Err() != nil
+	default:
+		return false
+	}
+}
+
+func (state *DockerState) Err() error {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+
+	return state.err
+}
+
+func (state *DockerState) Close() {
+	state.cancel()
+}
+
+func (state *DockerState) run(ctx context.Context) {
+	_, span := backgroundTracker.Start(ctx, fmt.Sprintf("Docker state of %s", state.conn.id))
+	defer span.End()
+	defer state.cancel()
+
+	// Subscribe before listing so that no change is lost between the list and the first event
+	eventStream, errStream := state.conn.dockerClient.Events(ctx, types.EventsOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("label", "com.docker.compose.project"),
+			filters.Arg("type", "container"),
+		),
+	})
+
+	err := state.load(ctx)
+	if err != nil {
+		span.RecordError(err)
+	}
+	state.fail(err)
+	close(state.ready)
+	if err != nil {
+		return
+	}
+
+	for {
+		select {
+		case event := <-eventStream:
+			if err := state.handleEvent(ctx, event); err != nil {
+				log.Printf("Failed to update docker state of %s because %s\n", state.conn.id, err)
+				span.RecordError(err)
+			}
+		case err := <-errStream:
+			if ctx.Err() == nil {
+				log.Printf("Docker state of %s stopped because %s\n", state.conn.id, err)
+				span.RecordError(err)
+			} else {
+				err = ctx.Err()
+			}
+
+			state.fail(err)
+			return
+		}
+	}
+}
+
+// fail records err and disconnects all subscribers so that they can resubscribe to a fresh state
+func (state *DockerState) fail(err error) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	state.err = err
+	if err == nil {
+		return
+	}
+
+	for subscriber := range state.subscribers {
+		delete(state.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+func (state *DockerState) load(ctx context.Context) error {
+	containers, err := state.conn.dockerClient.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: composeContainerFilters,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	for _, container := range containers {
+		inspect, err := state.conn.dockerClient.ContainerInspect(ctx, container.ID)
+		if dockerClient.IsErrNotFound(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to inspect container %s: %w", container.ID, err)
+		}
+
+		state.containers[container.ID] = inspect
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	state.document, err = toJsonDocument(DockerStateDocument{Containers: state.containers})
+	return err
+}
+
+func (state *DockerState) handleEvent(ctx context.Context, event events.Message) error {
+	// Exec events are frequent with health checks and do not change anything we keep
+	if strings.HasPrefix(event.Action, "exec_") {
+		return nil
+	}
+
+	inspect, err := state.conn.dockerClient.ContainerInspect(ctx, event.Actor.ID)
+	if err != nil && !dockerClient.IsErrNotFound(err) {
+		return fmt.Errorf("failed to inspect container %s: %w", event.Actor.ID, err)
+	}
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if err != nil {
+		delete(state.containers, event.Actor.ID)
+	} else {
+		state.containers[event.Actor.ID] = inspect
+	}
+
+	document, err := toJsonDocument(DockerStateDocument{Containers: state.containers})
+	if err != nil {
+		return err
+	}
+
+	patch := diffJsonDocuments("", state.document, document)
+	state.document = document
+	if len(patch) == 0 {
+		return nil
+	}
+
+	for subscriber := range state.subscribers {
+		select {
+		case subscriber <- patch:
+		default:
+			log.Printf("Disconnecting slow docker state subscriber on %s\n", state.conn.id)
+			delete(state.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+
+	return nil
+}
+
+// Snapshot returns the current state document
+func (state *DockerState) Snapshot() interface{} {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+
+	return state.document
+}
+
+// Subscribe returns the current document together with a channel of patches that apply on top of it.
+// The channel is closed when the subscriber falls behind or the state fails.
+func (state *DockerState) Subscribe() (interface{}, chan []JsonPatchOperation) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	subscriber := make(chan []JsonPatchOperation, subscriberBuffer)
+	if state.err != nil {
+		close(subscriber)
+	} else {
+		state.subscribers[subscriber] = struct{}{}
+	}
+
+	return state.document, subscriber
+}
+
+func (state *DockerState) Unsubscribe(subscriber chan []JsonPatchOperation) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if _, ok := state.subscribers[subscriber]; ok {
+		delete(state.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+func acquireDockerState(ctx iris.Context) (*ConnectionHandle, *DockerState, iris.Problem) {
+	handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
+	if err != nil {
+		return nil, nil, connectionProblem(err)
+	}
+
+	state, err := handle.conn.GetDockerState(ctx.Request().Context())
+	if err != nil {
+		handle.Close()
+		return nil, nil, iris.NewProblem().
+			Title("Docker state error").
+			Status(iris.StatusBadRequest).
+			Type("docker_state_err").
+			DetailErr(err)
+	}
+
+	return handle, state, nil
+}
+
+func dockerStateRoute(app *iris.Application) {
+	app.Get("/docker/state", func(ctx iris.Context) {
+		handle, state, problem := acquireDockerState(ctx)
+		if problem != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, problem)
+			return
+		}
+		defer handle.Close()
+
+		ctx.JSON(state.Snapshot())
+	}).SetName("Docker state")
+}
+
+func dockerStateStreamRoute(app *iris.Application) {
+	app.Get("/docker/state/stream", func(ctx iris.Context) {
+		handle, state, problem := acquireDockerState(ctx)
+		if problem != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, problem)
+			return
+		}
+		defer handle.Close()
+
+		document, patches := state.Subscribe()
+		defer state.Unsubscribe(patches)
+
+		lines := make(chan string)
+		go (func() {
+			defer close(lines)
+
+			// The initial document is sent as a patch replacing the whole document so that every message is a patch
+			initial := []JsonPatchOperation{{Op: "replace", Path: "", Value: document}}
+			for patch := initial; ; {
+				lineOut, _ := json.Marshal(patch)
+				select {
+				case lines <- string(lineOut):
+				case <-ctx.Request().Context().Done():
+					return
+				}
+
+				var ok bool
+				if patch, ok = <-patches; !ok {
+					return
+				}
+			}
+		})()
+
+		sse(ctx, lines)
+	}).SetName("Docker state stream")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/docker/docker/pkg/stdcopy"
+	"reflect"
+	"testing"
+)
+
+func logFrame(stream stdcopy.StdType, data string) []byte {
+	header := make([]byte, 8)
+	header[0] = byte(stream)
+	binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+	return append(header, data...)
+}
+
+func TestReadContainerLogsSplitsFramesIntoLines(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(logFrame(stdcopy.Stdout, "first\nsecond "))
+	stream.Write(logFrame(stdcopy.Stderr, "error\n"))
+	stream.Write(logFrame(stdcopy.Stdout, "half\nthird\n"))
+	stream.Write(logFrame(stdcopy.Stdout, "unterminated"))
+
+	var lines []ContainerLogLine
+	err := readContainerLogs(&stream, false, false, func(line ContainerLogLine) error {
+		lines = append(lines, line)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("readContainerLogs failed: %s", err)
+	}
+
+	expected := []ContainerLogLine{
+		{Stream: "stdout", Line: "first"},
+		{Stream: "stderr", Line: "error"},
+		{Stream: "stdout", Line: "second half"},
+		{Stream: "stdout", Line: "third"},
+		{Stream: "stdout", Line: "unterminated"},
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected %v, got %v", expected, lines)
+	}
+}
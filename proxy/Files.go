@@ -8,6 +8,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/kataras/iris/v12"
 	"github.com/kataras/iris/v12/middleware/jwt"
+	"github.com/pkg/sftp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
@@ -15,6 +16,8 @@ import (
 	"log"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -24,8 +27,50 @@ type FileInfo struct {
 	Size     int64  `json:"size"`
 }
 
+type FileEntry struct {
+	Name          string `json:"name"`
+	Path          string `json:"path"`
+	Size          int64  `json:"size"`
+	Mode          string `json:"mode"`
+	Permissions   uint32 `json:"permissions"`
+	ModTime       string `json:"modTime"`
+	Uid           uint32 `json:"uid"`
+	Gid           uint32 `json:"gid"`
+	Owner         string `json:"owner,omitempty"`
+	Group         string `json:"group,omitempty"`
+	IsDir         bool   `json:"isDir"`
+	IsSymlink     bool   `json:"isSymlink"`
+	SymlinkTarget string `json:"symlinkTarget,omitempty"`
+}
+
+// FileMetadata is the optional metadata applied when writing a file, unset fields keep the defaults of the SFTP server
+type FileMetadata struct {
+	Mode    string `json:"mode"` // octal permissions, e.g. 0644
+	Uid     *int   `json:"uid"`
+	Gid     *int   `json:"gid"`
+	Owner   string `json:"owner"` // user name, used when uid is not set
+	Group   string `json:"group"` // group name, used when gid is not set
+	ModTime string `json:"mod_time"`
+}
+
+// fileAttributes is FileMetadata resolved against the remote host
+type fileAttributes struct {
+	mode    *os.FileMode
+	uid     *int
+	gid     *int
+	modTime *time.Time
+}
+
 var fileTracer = otel.Tracer("File")
 
+// maxListEntries caps directory listings so that an accidental listing of / does not exhaust memory
+const maxListEntries = 10_000
+
+// maxListDepth and maxListDirectories bound the walk itself, a pattern that matches nothing would otherwise read the
+// whole tree without ever reaching maxListEntries
+const maxListDepth = 16
+const maxListDirectories = 1_000
+
 func (conn *SshConnection) readFile(ctx context.Context, path string, maxSize int64) (*FileInfo, error) {
 	log.Printf("Reading file at %s", path)
 	_, span := sshTracer.Start(ctx, fmt.Sprintf("Read file %s", path))
@@ -68,12 +113,146 @@ func (conn *SshConnection) readFile(ctx context.Context, path string, maxSize in
 		}
 
 		resp.Contents = contents
+		fileBytes.WithLabelValues("read").Add(float64(len(contents)))
 	}
 
 	return &resp, nil
 }
 
-func (conn *SshConnection) writeFile(ctx context.Context, path string, contents []byte) error {
+func (conn *SshConnection) resolveFileMetadata(metadata *FileMetadata) (*fileAttributes, error) {
+	attrs := fileAttributes{
+		uid: metadata.Uid,
+		gid: metadata.Gid,
+	}
+
+	if metadata.Mode != "" {
+		mode, err := strconv.ParseUint(metadata.Mode, 8, 32)
+		if err != nil || mode > 0777 {
+			return nil, fmt.Errorf("invalid file mode %s", metadata.Mode)
+		}
+
+		fileMode := os.FileMode(mode)
+		attrs.mode = &fileMode
+	}
+
+	if attrs.uid != nil && *attrs.uid < 0 {
+		return nil, fmt.Errorf("invalid uid %d", *attrs.uid)
+	}
+
+	if attrs.gid != nil && *attrs.gid < 0 {
+		return nil, fmt.Errorf("invalid gid %d", *attrs.gid)
+	}
+
+	// Names are resolved even when the id is given, so that a name that does not exist is never silently ignored
+	if metadata.Owner != "" || metadata.Group != "" {
+		owners := conn.readFileOwners()
+
+		if metadata.Owner != "" {
+			uid, err := lookupIdByName(owners.users, metadata.Owner)
+			if err != nil {
+				return nil, fmt.Errorf("unknown owner %s", metadata.Owner)
+			}
+			if attrs.uid == nil {
+				attrs.uid = &uid
+			}
+		}
+
+		if metadata.Group != "" {
+			gid, err := lookupIdByName(owners.groups, metadata.Group)
+			if err != nil {
+				return nil, fmt.Errorf("unknown group %s", metadata.Group)
+			}
+			if attrs.gid == nil {
+				attrs.gid = &gid
+			}
+		}
+	}
+
+	if metadata.ModTime != "" {
+		modTime, err := time.Parse(time.RFC3339, metadata.ModTime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mod_time %s: %w", metadata.ModTime, err)
+		}
+		attrs.modTime = &modTime
+	}
+
+	return &attrs, nil
+}
+
+func lookupIdByName(names map[uint32]string, name string) (int, error) {
+	for id, candidate := range names {
+		if candidate == name {
+			return int(id), nil
+		}
+	}
+
+	return 0, os.ErrNotExist
+}
+
+// matches tells whether stat already has all the requested attributes
+func (attrs *fileAttributes) matches(stat os.FileInfo) bool {
+	if attrs.mode != nil && stat.Mode().Perm() != *attrs.mode {
+		return false
+	}
+
+	if attrs.modTime != nil && !stat.ModTime().Equal(attrs.modTime.Truncate(time.Second)) {
+		return false
+	}
+
+	if fileStat, ok := stat.Sys().(*sftp.FileStat); ok {
+		if attrs.uid != nil && int(fileStat.UID) != *attrs.uid {
+			return false
+		}
+
+		if attrs.gid != nil && int(fileStat.GID) != *attrs.gid {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (conn *SshConnection) applyFileAttributes(filePath string, attrs *fileAttributes) error {
+	if attrs.mode != nil {
+		if err := conn.sftpClient.Chmod(filePath, *attrs.mode); err != nil {
+			return fmt.Errorf("failed to change file mode: %w", err)
+		}
+	}
+
+	if attrs.uid != nil || attrs.gid != nil {
+		stat, err := conn.sftpClient.Stat(filePath)
+		if err != nil {
+			return fmt.Errorf("error reading file metadata: %w", err)
+		}
+
+		uid, gid := -1, -1
+		if fileStat, ok := stat.Sys().(*sftp.FileStat); ok {
+			uid, gid = int(fileStat.UID), int(fileStat.GID)
+		}
+
+		if attrs.uid != nil {
+			uid = *attrs.uid
+		}
+
+		if attrs.gid != nil {
+			gid = *attrs.gid
+		}
+
+		if err := conn.sftpClient.Chown(filePath, uid, gid); err != nil {
+			return fmt.Errorf("failed to change file owner: %w", err)
+		}
+	}
+
+	if attrs.modTime != nil {
+		if err := conn.sftpClient.Chtimes(filePath, time.Now(), *attrs.modTime); err != nil {
+			return fmt.Errorf("failed to change file modification time: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (conn *SshConnection) writeFile(ctx context.Context, path string, contents []byte, attrs *fileAttributes) error {
 	tempFilePath := fmt.Sprintf("/tmp/%s", uuid.New().String())
 
 	childCtx, span := sshTracer.Start(ctx, fmt.Sprintf("Write file %s", path))
@@ -92,6 +271,16 @@ func (conn *SshConnection) writeFile(ctx context.Context, path string, contents
 		span.RecordError(err)
 		return fmt.Errorf("failed to open temp file: %w", err)
 	}
+
+	// The temp file is removed on every path that does not end with it moved onto the target
+	moved := false
+	defer func() {
+		if !moved {
+			if err := conn.sftpClient.Remove(tempFilePath); err != nil {
+				log.Printf("Failed to remove temp file %s because %s", tempFilePath, err)
+			}
+		}
+	}()
 	defer tempFileHandle.Close()
 
 	span.AddEvent("Writing temp file")
@@ -99,14 +288,30 @@ func (conn *SshConnection) writeFile(ctx context.Context, path string, contents
 		span.RecordError(err)
 		return fmt.Errorf("failed to write temp file: %w", err)
 	}
+	fileBytes.WithLabelValues("write").Add(float64(len(contents)))
+
+	// Metadata is applied to the temp file so that the target never exists with the wrong mode or owner
+	if attrs != nil {
+		span.AddEvent("Applying file attributes")
+		if err := conn.applyFileAttributes(tempFilePath, attrs); err != nil {
+			span.RecordError(err)
+			return err
+		}
+	}
 
 	span.AddEvent("Running move command")
-	moveCommand := fmt.Sprintf("mv --force '%s' '%s'", tempFilePath, path)
-	if _, err := conn.RunCommand(childCtx, moveCommand); err != nil {
+	moveCommand := fmt.Sprintf("mv --force %s %s", shellQuote(tempFilePath), shellQuote(path))
+	res, err := conn.RunCommand(childCtx, moveCommand)
+	if err != nil {
 		span.RecordError(err)
 		return fmt.Errorf("failed to move temp file to target path: %w", err)
+	} else if res.Code != 0 || res.Error != "" {
+		err := fmt.Errorf("failed to move temp file to target path: %s%s", res.Error, strings.TrimSpace(string(res.Stderr)))
+		span.RecordError(err)
+		return err
 	}
 
+	moved = true
 	return nil
 }
 
@@ -141,53 +346,65 @@ func (conn *SshConnection) ensureDirectoryExists(ctx context.Context, path strin
 	}
 }
 
-func (conn *SshConnection) upsertFile(ctx context.Context, filePath string, createDir bool, targetContents []byte) (bool, error) {
-	childCtx, span := sshTracer.Start(ctx, fmt.Sprintf("Upsert file %s", filePath))
-	span.SetAttributes(attribute.Bool("file.create_dir", createDir))
-	span.SetAttributes(attribute.Int("file.content_len", len(targetContents)))
+// fileDiffers reports whether filePath is missing or its contents or attributes differ from the target
+func (conn *SshConnection) fileDiffers(ctx context.Context, filePath string, targetContents []byte, attrs *fileAttributes) (bool, error) {
+	_, span := sshTracer.Start(ctx, fmt.Sprintf("Compare file %s", filePath))
 	defer span.End()
 
-	log.Printf("Upserting file at %s", filePath)
-
 	span.AddEvent("Opening file")
 	fileHandle, err := conn.sftpClient.Open(filePath)
-	write := false
 	if err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
-			span.RecordError(err)
-			return false, fmt.Errorf("error opening file: %w", err)
-		} else {
-			write = true
+		if errors.Is(err, os.ErrNotExist) {
+			return true, nil
 		}
-	} else {
-		defer fileHandle.Close()
+
+		span.RecordError(err)
+		return false, fmt.Errorf("error opening file: %w", err)
 	}
+	defer fileHandle.Close()
 
-	if fileHandle != nil {
-		span.AddEvent("Reading file stats")
-		stat, err := fileHandle.Stat()
-		if err != nil {
-			span.RecordError(err)
-			return false, fmt.Errorf("error reading file metadata: %w", err)
-		}
+	span.AddEvent("Reading file stats")
+	stat, err := fileHandle.Stat()
+	if err != nil {
+		span.RecordError(err)
+		return false, fmt.Errorf("error reading file metadata: %w", err)
+	}
 
-		if stat.IsDir() {
-			span.RecordError(fmt.Errorf("cannot upsert a directory"))
-			return false, fmt.Errorf("cannot upsert a directory")
-		}
+	if stat.IsDir() {
+		span.RecordError(fmt.Errorf("cannot upsert a directory"))
+		return false, fmt.Errorf("cannot upsert a directory")
+	}
 
-		if stat.Size() != int64(len(targetContents)) {
-			write = true
-		} else {
-			span.AddEvent("Reading contents")
-			contents, err := io.ReadAll(fileHandle)
-			if err != nil {
-				span.RecordError(err)
-				return false, fmt.Errorf("failed to read file contents: %w", err)
-			}
+	if stat.Size() != int64(len(targetContents)) {
+		return true, nil
+	} else if attrs != nil && !attrs.matches(stat) {
+		span.AddEvent("File attributes differ")
+		return true, nil
+	}
 
-			write = !bytes.Equal(contents, targetContents)
-		}
+	span.AddEvent("Reading contents")
+	contents, err := io.ReadAll(fileHandle)
+	if err != nil {
+		span.RecordError(err)
+		return false, fmt.Errorf("failed to read file contents: %w", err)
+	}
+
+	fileBytes.WithLabelValues("read").Add(float64(len(contents)))
+	return !bytes.Equal(contents, targetContents), nil
+}
+
+func (conn *SshConnection) upsertFile(ctx context.Context, filePath string, createDir bool, targetContents []byte, attrs *fileAttributes) (bool, error) {
+	childCtx, span := sshTracer.Start(ctx, fmt.Sprintf("Upsert file %s", filePath))
+	span.SetAttributes(attribute.Bool("file.create_dir", createDir))
+	span.SetAttributes(attribute.Int("file.content_len", len(targetContents)))
+	defer span.End()
+
+	log.Printf("Upserting file at %s", filePath)
+
+	write, err := conn.fileDiffers(childCtx, filePath, targetContents, attrs)
+	if err != nil {
+		span.RecordError(err)
+		return false, err
 	}
 
 	if write {
@@ -201,7 +418,7 @@ func (conn *SshConnection) upsertFile(ctx context.Context, filePath string, crea
 		}
 
 		span.AddEvent("Writing file")
-		if err := conn.writeFile(childCtx, filePath, targetContents); err != nil {
+		if err := conn.writeFile(childCtx, filePath, targetContents, attrs); err != nil {
 			span.RecordError(err)
 			return false, err
 		}
@@ -241,12 +458,168 @@ func (conn *SshConnection) deleteFile(ctx context.Context, filePath string) (boo
 	return true, nil
 }
 
+// fileOwners maps numeric ids to user and group names of the remote host
+type fileOwners struct {
+	users  map[uint32]string
+	groups map[uint32]string
+}
+
+// readIdNames parses /etc/passwd or /etc/group style files into id to name map
+func (conn *SshConnection) readIdNames(filePath string) map[uint32]string {
+	names := make(map[uint32]string)
+
+	fileHandle, err := conn.sftpClient.Open(filePath)
+	if err != nil {
+		return names
+	}
+	defer fileHandle.Close()
+
+	contents, err := io.ReadAll(fileHandle)
+	if err != nil {
+		return names
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 {
+			continue
+		}
+
+		if id, err := strconv.ParseUint(fields[2], 10, 32); err == nil {
+			names[uint32(id)] = fields[0]
+		}
+	}
+
+	return names
+}
+
+func (conn *SshConnection) readFileOwners() *fileOwners {
+	return &fileOwners{
+		users:  conn.readIdNames("/etc/passwd"),
+		groups: conn.readIdNames("/etc/group"),
+	}
+}
+
+func (conn *SshConnection) fileEntry(filePath string, stat os.FileInfo, owners *fileOwners) FileEntry {
+	entry := FileEntry{
+		Name:        stat.Name(),
+		Path:        filePath,
+		Size:        stat.Size(),
+		Mode:        stat.Mode().String(),
+		Permissions: uint32(stat.Mode().Perm()),
+		ModTime:     stat.ModTime().UTC().Format(time.RFC3339),
+		IsDir:       stat.IsDir(),
+		IsSymlink:   stat.Mode()&os.ModeSymlink != 0,
+	}
+
+	if fileStat, ok := stat.Sys().(*sftp.FileStat); ok {
+		entry.Uid = fileStat.UID
+		entry.Gid = fileStat.GID
+		entry.Owner = owners.users[fileStat.UID]
+		entry.Group = owners.groups[fileStat.GID]
+	}
+
+	if entry.IsSymlink {
+		if target, err := conn.sftpClient.ReadLink(filePath); err == nil {
+			entry.SymlinkTarget = target
+		}
+	}
+
+	return entry
+}
+
+func (conn *SshConnection) statFile(ctx context.Context, filePath string) (*FileEntry, error) {
+	_, span := sshTracer.Start(ctx, fmt.Sprintf("Stat file %s", filePath))
+	defer span.End()
+
+	log.Printf("Statting file at %s", filePath)
+
+	stat, err := conn.sftpClient.Lstat(filePath)
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("error reading file metadata: %w", err)
+	}
+
+	entry := conn.fileEntry(filePath, stat, conn.readFileOwners())
+	return &entry, nil
+}
+
+// listDirectory lists dirPath down to depth levels, only entries whose name matches pattern are returned
+// but all directories are descended into. Symlinked directories are not followed.
+func (conn *SshConnection) listDirectory(ctx context.Context, dirPath string, depth int, pattern string) ([]FileEntry, error) {
+	_, span := sshTracer.Start(ctx, fmt.Sprintf("List directory %s", dirPath))
+	span.SetAttributes(attribute.Int("file.depth", depth))
+	span.SetAttributes(attribute.String("file.pattern", pattern))
+	defer span.End()
+
+	log.Printf("Listing directory at %s", dirPath)
+
+	if pattern != "" {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+		}
+	}
+
+	if depth > maxListDepth {
+		return nil, fmt.Errorf("depth has to be at most %d", maxListDepth)
+	}
+
+	entries := make([]FileEntry, 0)
+	owners := conn.readFileOwners()
+	visited := 0
+
+	var walk func(dir string, level int) error
+	walk = func(dir string, level int) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		visited++
+		if visited > maxListDirectories {
+			return fmt.Errorf("directory listing exceeds %d directories", maxListDirectories)
+		}
+
+		span.AddEvent(fmt.Sprintf("Reading directory %s", dir))
+		stats, err := conn.sftpClient.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("error reading directory %s: %w", dir, err)
+		}
+
+		for _, stat := range stats {
+			entryPath := path.Join(dir, stat.Name())
+
+			if matched, _ := path.Match(pattern, stat.Name()); pattern == "" || matched {
+				if len(entries) >= maxListEntries {
+					return fmt.Errorf("directory listing exceeds %d entries", maxListEntries)
+				}
+
+				entries = append(entries, conn.fileEntry(entryPath, stat, owners))
+			}
+
+			if stat.IsDir() && level < depth {
+				if err := walk(entryPath, level+1); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	if err := walk(dirPath, 1); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	return entries, nil
+}
+
 func writeFileRoute(app *iris.Application) {
 	type FileWriteRequest struct {
+		FileMetadata
 		Contents     []byte `json:"contents" validate:"required"`
 		Path         string `json:"path" validate:"required"`
 		CreateFolder bool   `json:"create_folder"`
-		ModTime      string `json:"mod_time"`
 	}
 
 	app.Post("/files/write", func(ctx iris.Context) {
@@ -261,27 +634,35 @@ func writeFileRoute(app *iris.Application) {
 
 		connectionHandle, fileStatError := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
 		if fileStatError != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
-				Title("Connection to target host failed").
-				Type("connection_err").
-				DetailErr(fileStatError))
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(fileStatError))
 			return
 		}
 		defer connectionHandle.Close()
 
+		attrs, err := connectionHandle.conn.resolveFileMetadata(&body.FileMetadata)
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionHandle.problem(iris.NewProblem().
+				Title("Invalid file metadata").
+				Type("file_metadata").
+				DetailErr(err)))
+			return
+		}
+
 		dir := path.Dir(body.Path)
 		if err := connectionHandle.conn.ensureDirectoryExists(ctx.Request().Context(), dir); err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionHandle.problem(iris.NewProblem().
 				Title("Could not create parent folder").
 				Type("folder_create").
-				DetailErr(err))
+				DetailErr(err)))
+			return
 		}
 
-		if err := connectionHandle.conn.writeFile(ctx.Request().Context(), body.Path, body.Contents); err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+		if err := connectionHandle.conn.writeFile(ctx.Request().Context(), body.Path, body.Contents, attrs); err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionHandle.problem(iris.NewProblem().
 				Title("Could not write file").
 				Type("file_write").
-				DetailErr(err))
+				DetailErr(err)))
+			return
 		}
 
 		ctx.StatusCode(iris.StatusOK)
@@ -292,20 +673,17 @@ func readFileRoute(app *iris.Application) {
 	app.Get("/files/read", func(ctx iris.Context) {
 		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
 		if err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
-				Title("Connection to target host failed").
-				Type("connection_err").
-				DetailErr(err))
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
 			return
 		}
 		defer handle.Close()
 
 		fileData, err := handle.conn.readFile(ctx.Request().Context(), ctx.URLParam("path"), 10_000_000)
 		if err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
 				Title("Could not read file").
 				Type("file_open").
-				DetailErr(err))
+				DetailErr(err)))
 			return
 		}
 
@@ -315,6 +693,7 @@ func readFileRoute(app *iris.Application) {
 
 func upsertFileRoute(app *iris.Application) {
 	type FileUpsertRequest struct {
+		FileMetadata
 		Contents     []byte `json:"contents" validate:"required"`
 		Path         string `json:"path" validate:"required"`
 		CreateFolder bool   `json:"create_folder"`
@@ -336,20 +715,26 @@ func upsertFileRoute(app *iris.Application) {
 
 		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
 		if err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
-				Title("Connection to target host failed").
-				Type("connection_err").
-				DetailErr(err))
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
 			return
 		}
 		defer handle.Close()
 
-		updated, err := handle.conn.upsertFile(ctx.Request().Context(), body.Path, body.CreateFolder, body.Contents)
+		attrs, err := handle.conn.resolveFileMetadata(&body.FileMetadata)
 		if err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Invalid file metadata").
+				Type("file_metadata").
+				DetailErr(err)))
+			return
+		}
+
+		updated, err := handle.conn.upsertFile(ctx.Request().Context(), body.Path, body.CreateFolder, body.Contents, attrs)
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
 				Title("Could not upsert file").
 				Type("file_upsert").
-				DetailErr(err))
+				DetailErr(err)))
 			return
 		}
 
@@ -367,10 +752,7 @@ func deleteFileRoute(app *iris.Application) {
 	app.Post("/files/delete", func(ctx iris.Context) {
 		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
 		if err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
-				Title("Connection to target host failed").
-				Type("connection_err").
-				DetailErr(err))
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
 			return
 		}
 		defer handle.Close()
@@ -378,10 +760,10 @@ func deleteFileRoute(app *iris.Application) {
 		log.Printf("Deleting file at %s", ctx.URLParam("path"))
 		deleted, err := handle.conn.deleteFile(ctx.Request().Context(), ctx.URLParam("path"))
 		if err := handle.conn.sftpClient.Remove(ctx.URLParam("path")); err != nil && !errors.Is(err, os.ErrNotExist) {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
 				Title("Could not delete file").
 				Type("file_delete").
-				DetailErr(err))
+				DetailErr(err)))
 			return
 		}
 
@@ -390,3 +772,64 @@ func deleteFileRoute(app *iris.Application) {
 		})
 	}).SetName("File delete")
 }
+
+func statFileRoute(app *iris.Application) {
+	app.Get("/files/stat", func(ctx iris.Context) {
+		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
+			return
+		}
+		defer handle.Close()
+
+		entry, err := handle.conn.statFile(ctx.Request().Context(), ctx.URLParam("path"))
+		if errors.Is(err, os.ErrNotExist) {
+			ctx.StopWithProblem(iris.StatusNotFound, iris.NewProblem().
+				Title("File does not exist").
+				Type("file_not_found").
+				DetailErr(err))
+			return
+		} else if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Could not stat file").
+				Type("file_stat").
+				DetailErr(err)))
+			return
+		}
+
+		ctx.JSON(entry)
+	}).SetName("File stat")
+}
+
+func listFilesRoute(app *iris.Application) {
+	app.Get("/files/list", func(ctx iris.Context) {
+		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
+			return
+		}
+		defer handle.Close()
+
+		depth := ctx.URLParamIntDefault("depth", 1)
+		if depth < 1 {
+			depth = 1
+		} else if depth > maxListDepth {
+			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+				Title("Invalid depth").
+				Type("file_list").
+				Detail(fmt.Sprintf("depth has to be between 1 and %d", maxListDepth)))
+			return
+		}
+
+		entries, err := handle.conn.listDirectory(ctx.Request().Context(), ctx.URLParam("path"), depth, ctx.URLParam("pattern"))
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Could not list directory").
+				Type("file_list").
+				DetailErr(err)))
+			return
+		}
+
+		ctx.JSON(entries)
+	}).SetName("File list")
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// HostKeyModeTofu trusts and stores the host key on first connection and rejects any later change
+	HostKeyModeTofu = "tofu"
+	// HostKeyModeStrict only accepts host keys given in credentials or already present in known hosts
+	HostKeyModeStrict = "strict"
+	// HostKeyModeInsecure skips host key verification entirely
+	HostKeyModeInsecure = "insecure"
+)
+
+type HostKeyError struct {
+	Host        string
+	Fingerprint string
+	Mismatch    bool
+}
+
+func (e *HostKeyError) Error() string {
+	if e.Mismatch {
+		return fmt.Sprintf("host key for %s changed, presented key %s does not match the expected one", e.Host, e.Fingerprint)
+	}
+
+	return fmt.Sprintf("host key %s for %s is not trusted", e.Fingerprint, e.Host)
+}
+
+// knownHostsMu serializes reads and appends to the known hosts file
+var knownHostsMu sync.Mutex
+
+func knownHostsPath() string {
+	return viper.GetString("KNOWN_HOSTS_PATH")
+}
+
+// hostKeyMatches compares a presented key against an expected value, which is either a
+// public key in authorized_keys format or a SHA256 fingerprint as printed by ssh-keygen -l
+func hostKeyMatches(expected string, key ssh.PublicKey) (bool, error) {
+	expected = strings.TrimSpace(expected)
+
+	if strings.HasPrefix(expected, "SHA256:") {
+		return expected == ssh.FingerprintSHA256(key), nil
+	}
+
+	expectedKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(expected))
+	if err != nil {
+		return false, fmt.Errorf("failed to parse expected host key: %w", err)
+	}
+
+	return bytes.Equal(expectedKey.Marshal(), key.Marshal()), nil
+}
+
+// checkKnownHosts and appendKnownHost expect knownHostsMu to be held
+func checkKnownHosts(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if _, err := os.Stat(knownHostsPath()); errors.Is(err, os.ErrNotExist) {
+		return &knownhosts.KeyError{}
+	}
+
+	callback, err := knownhosts.New(knownHostsPath())
+	if err != nil {
+		return fmt.Errorf("failed to read known hosts: %w", err)
+	}
+
+	return callback(hostname, remote, key)
+}
+
+func appendKnownHost(hostname string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(knownHostsPath()), 0700); err != nil {
+		return fmt.Errorf("failed to create known hosts directory: %w", err)
+	}
+
+	file, err := os.OpenFile(knownHostsPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open known hosts: %w", err)
+	}
+	defer file.Close()
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+	if _, err := file.WriteString(line + "\n"); err != nil {
+		return fmt.Errorf("failed to write known hosts: %w", err)
+	}
+
+	return nil
+}
+
+// createHostKeyCallback verifies host keys according to the host key mode. The ssh package only keeps the message of
+// a callback error, so the error a key was rejected with is also stored in rejected for the caller to return.
+func createHostKeyCallback(args *SshConnectionCredentials, rejected *error) (ssh.HostKeyCallback, error) {
+	mode := args.HostKeyMode
+	if mode == "" {
+		mode = viper.GetString("HOST_KEY_MODE")
+	}
+
+	switch mode {
+	case HostKeyModeInsecure, HostKeyModeTofu, HostKeyModeStrict:
+		break
+	default:
+		return nil, fmt.Errorf("unknown host key mode %s", mode)
+	}
+
+	verify := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+
+		// Key pinned by the caller always takes precedence over the known hosts store
+		if args.HostKey != "" {
+			matches, err := hostKeyMatches(args.HostKey, key)
+			if err != nil {
+				return err
+			}
+
+			if !matches {
+				return &HostKeyError{Host: hostname, Fingerprint: fingerprint, Mismatch: true}
+			}
+
+			return nil
+		}
+
+		if mode == HostKeyModeInsecure {
+			return nil
+		}
+
+		return verifyKnownHost(hostname, remote, key, mode)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := verify(hostname, remote, key)
+		*rejected = err
+		return err
+	}, nil
+}
+
+// verifyKnownHost checks key against the known hosts store and trusts it on first use in tofu mode. The check and the
+// append happen under one lock, otherwise two first connections presenting different keys could both be trusted.
+func verifyKnownHost(hostname string, remote net.Addr, key ssh.PublicKey, mode string) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+
+	fingerprint := ssh.FingerprintSHA256(key)
+
+	err := checkKnownHosts(hostname, remote, key)
+	if err == nil {
+		return nil
+	}
+
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return err
+	}
+
+	if len(keyErr.Want) > 0 {
+		return &HostKeyError{Host: hostname, Fingerprint: fingerprint, Mismatch: true}
+	}
+
+	if mode == HostKeyModeStrict {
+		return &HostKeyError{Host: hostname, Fingerprint: fingerprint}
+	}
+
+	log.Printf("Trusting host key %s for %s on first use", fingerprint, hostname)
+	return appendKnownHost(hostname, key)
+}
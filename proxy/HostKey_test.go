@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func randomHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	key, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatalf("failed to convert key: %s", err)
+	}
+
+	return key
+}
+
+func useKnownHosts(t *testing.T) {
+	t.Helper()
+
+	previous := viper.GetString("KNOWN_HOSTS_PATH")
+	viper.Set("KNOWN_HOSTS_PATH", filepath.Join(t.TempDir(), "known_hosts"))
+	t.Cleanup(func() {
+		viper.Set("KNOWN_HOSTS_PATH", previous)
+	})
+}
+
+func expectHostKeyProblem(t *testing.T, err error, mismatch bool, problemType string) {
+	t.Helper()
+
+	var hostKeyErr *HostKeyError
+	if !errors.As(err, &hostKeyErr) {
+		t.Fatalf("expected a HostKeyError, got %v", err)
+	}
+	if hostKeyErr.Mismatch != mismatch {
+		t.Errorf("expected mismatch to be %t", mismatch)
+	}
+
+	if got := connectionProblem(err)["type"]; got != problemType {
+		t.Errorf("expected problem type %s, got %v", problemType, got)
+	}
+}
+
+func TestPinnedHostKeyMismatch(t *testing.T) {
+	server := startTestServer(t)
+
+	credentials := server.credentials()
+	credentials.HostKey = string(ssh.MarshalAuthorizedKey(randomHostKey(t)))
+
+	_, err := GetConnection(context.Background(), credentials)
+	expectHostKeyProblem(t, err, true, "host_key_mismatch")
+}
+
+func TestPinnedHostKeyEnforcedInInsecureMode(t *testing.T) {
+	server := startTestServer(t)
+
+	credentials := server.credentials()
+	credentials.HostKey = ssh.FingerprintSHA256(randomHostKey(t))
+	credentials.HostKeyMode = HostKeyModeInsecure
+
+	_, err := GetConnection(context.Background(), credentials)
+	expectHostKeyProblem(t, err, true, "host_key_mismatch")
+}
+
+func TestUnknownHostKeyInStrictMode(t *testing.T) {
+	server := startTestServer(t)
+	useKnownHosts(t)
+
+	credentials := server.credentials()
+	credentials.HostKey = ""
+	credentials.HostKeyMode = HostKeyModeStrict
+
+	_, err := GetConnection(context.Background(), credentials)
+	expectHostKeyProblem(t, err, false, "host_key_unknown")
+}
+
+func TestTrustOnFirstUse(t *testing.T) {
+	server := startTestServer(t)
+	useKnownHosts(t)
+
+	credentials := server.credentials()
+	credentials.HostKey = ""
+	credentials.HostKeyMode = HostKeyModeTofu
+
+	handle, err := GetConnection(context.Background(), credentials)
+	if err != nil {
+		t.Fatalf("first connection in tofu mode failed: %s", err)
+	}
+	handle.Close()
+
+	// The stored key is now enough for strict mode
+	credentials.HostKeyMode = HostKeyModeStrict
+	CloseAllConnections()
+
+	handle, err = GetConnection(context.Background(), credentials)
+	if err != nil {
+		t.Fatalf("connection with the trusted key in strict mode failed: %s", err)
+	}
+	handle.Close()
+}
+
+func TestTrustOnFirstUseTrustsOneKey(t *testing.T) {
+	useKnownHosts(t)
+
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+	keys := []ssh.PublicKey{randomHostKey(t), randomHostKey(t)}
+
+	// Two first connections presenting different keys, only one of them may be trusted
+	var trusted int32
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key ssh.PublicKey) {
+			defer wg.Done()
+			if verifyKnownHost("host:22", remote, key, HostKeyModeTofu) == nil {
+				atomic.AddInt32(&trusted, 1)
+			}
+		}(key)
+	}
+	wg.Wait()
+
+	if trusted != 1 {
+		t.Fatalf("expected exactly one key to be trusted on first use, %d were", trusted)
+	}
+}
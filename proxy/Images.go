@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/middleware/jwt"
+	"io"
+	"log"
+)
+
+type ImagePullRequest struct {
+	Image    string `json:"image" validate:"required"`
+	Platform string `json:"platform"`
+	// Auth is used for private registries, ServerAddress has to match the registry of the image
+	Auth *types.AuthConfig `json:"auth"`
+}
+
+// encodeRegistryAuth encodes credentials the way the X-Registry-Auth header expects them
+func encodeRegistryAuth(auth *types.AuthConfig) (string, error) {
+	if auth == nil {
+		return "", nil
+	}
+
+	encoded, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.URLEncoding.EncodeToString(encoded), nil
+}
+
+func imagesRoute(app *iris.Application) {
+	app.Get("/docker/images", func(ctx iris.Context) {
+		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
+			return
+		}
+		defer handle.Close()
+
+		all, _ := ctx.URLParamBool("all")
+		imageFilters := filters.NewArgs()
+		if dangling := ctx.URLParam("dangling"); dangling != "" {
+			imageFilters.Add("dangling", dangling)
+		}
+		for _, reference := range ctx.URLParamSlice("reference") {
+			imageFilters.Add("reference", reference)
+		}
+
+		log.Printf("Reading images")
+		images, err := handle.conn.dockerClient.ImageList(ctx.Request().Context(), types.ImageListOptions{
+			All:     all,
+			Filters: imageFilters,
+		})
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Listing images failed").
+				Type("docker_image_err").
+				DetailErr(err)))
+			return
+		}
+
+		ctx.JSON(images)
+	}).SetName("Docker images")
+}
+
+func imagePullRoute(app *iris.Application) {
+	app.Post("/docker/images/pull", func(ctx iris.Context) {
+		var request ImagePullRequest
+		if err := ctx.ReadJSON(&request); err != nil {
+			ctx.StopWithError(iris.StatusBadRequest, err)
+			return
+		}
+
+		registryAuth, err := encodeRegistryAuth(request.Auth)
+		if err != nil {
+			ctx.StopWithError(iris.StatusBadRequest, err)
+			return
+		}
+
+		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
+			return
+		}
+		defer handle.Close()
+
+		log.Printf("Pulling image %s", request.Image)
+		progress, err := handle.conn.dockerClient.ImagePull(ctx.Request().Context(), request.Image, types.ImagePullOptions{
+			RegistryAuth: registryAuth,
+			Platform:     request.Platform,
+		})
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Pulling image failed").
+				Type("docker_image_err").
+				DetailErr(err)))
+			return
+		}
+		defer progress.Close()
+
+		// Progress is forwarded as docker reports it, a failed pull ends with a message that has errorDetail set
+		lines := make(chan string)
+		go (func() {
+			defer close(lines)
+
+			decoder := json.NewDecoder(progress)
+			for {
+				var message jsonmessage.JSONMessage
+				if err := decoder.Decode(&message); err == io.EOF {
+					return
+				} else if err != nil {
+					if ctx.Request().Context().Err() == nil {
+						log.Printf("Received error %v\n", err)
+						lineOut, _ := json.Marshal(iris.NewProblem().
+							Title("Error reading pull progress").
+							Type("stream_err").
+							DetailErr(err))
+						lines <- string(lineOut)
+					}
+					return
+				}
+
+				lineOut, _ := json.Marshal(message)
+				select {
+				case lines <- string(lineOut):
+				case <-ctx.Request().Context().Done():
+					return
+				}
+			}
+		})()
+
+		sse(ctx, lines)
+	}).SetName("Docker image pull")
+}
+
+func imageDeleteRoute(app *iris.Application) {
+	app.Delete("/docker/images/{id:path}", func(ctx iris.Context) {
+		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
+			return
+		}
+		defer handle.Close()
+
+		force, _ := ctx.URLParamBool("force")
+		pruneChildren := true
+		if ctx.URLParamExists("prune_children") {
+			pruneChildren, _ = ctx.URLParamBool("prune_children")
+		}
+
+		log.Printf("Deleting image %s", ctx.Params().Get("id"))
+		deleted, err := handle.conn.dockerClient.ImageRemove(ctx.Request().Context(), ctx.Params().Get("id"), types.ImageRemoveOptions{
+			Force:         force,
+			PruneChildren: pruneChildren,
+		})
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Deleting image failed").
+				Type("docker_image_err").
+				DetailErr(err)))
+			return
+		}
+
+		ctx.JSON(deleted)
+	}).SetName("Docker image delete")
+}
+
+func imagePruneRoute(app *iris.Application) {
+	app.Post("/docker/images/prune", func(ctx iris.Context) {
+		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
+			return
+		}
+		defer handle.Close()
+
+		// Only dangling images are pruned unless all unused images are asked for, same as docker image prune
+		pruneFilters := filters.NewArgs()
+		if all, _ := ctx.URLParamBool("all"); all {
+			pruneFilters.Add("dangling", "false")
+		}
+		if until := ctx.URLParam("until"); until != "" {
+			pruneFilters.Add("until", until)
+		}
+
+		log.Printf("Pruning images")
+		report, err := handle.conn.dockerClient.ImagesPrune(ctx.Request().Context(), pruneFilters)
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Pruning images failed").
+				Type("docker_image_err").
+				DetailErr(err)))
+			return
+		}
+
+		ctx.JSON(report)
+	}).SetName("Docker image prune")
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/middleware/jwt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultJournalLines = 1000
+const maxJournalLines = 100000
+
+type JournalEntry struct {
+	Cursor     string    `json:"cursor"`
+	Timestamp  time.Time `json:"timestamp"`
+	Unit       string    `json:"unit"`
+	Priority   int       `json:"priority"` // 0 emerg to 7 debug
+	Identifier string    `json:"identifier"`
+	Pid        int       `json:"pid"`
+	BootId     string    `json:"bootId"`
+	Message    string    `json:"message"`
+}
+
+type JournalResponse struct {
+	Entries []JournalEntry `json:"entries"`
+	// Cursor of the last entry, pass it as cursor to read the entries that follow
+	Cursor string `json:"cursor"`
+}
+
+type JournalQuery struct {
+	Unit     string
+	Cursor   string
+	Since    string
+	Until    string
+	Lines    int // 0 leaves the limit to journalctl
+	Priority string
+	Follow   bool
+}
+
+// journalMessage decodes MESSAGE, which journalctl prints as an array of bytes when it is not valid UTF-8
+func journalMessage(raw json.RawMessage) string {
+	var message string
+	if err := json.Unmarshal(raw, &message); err == nil {
+		return message
+	}
+
+	var data []byte
+	var values []int
+	if err := json.Unmarshal(raw, &values); err == nil {
+		for _, value := range values {
+			data = append(data, byte(value))
+		}
+	}
+
+	return string(data)
+}
+
+func parseJournalEntry(line []byte) (JournalEntry, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return JournalEntry{}, fmt.Errorf("failed to parse journal entry: %w", err)
+	}
+
+	field := func(name string) string {
+		var value string
+		json.Unmarshal(fields[name], &value)
+		return value
+	}
+
+	entry := JournalEntry{
+		Cursor:     field("__CURSOR"),
+		Unit:       field("_SYSTEMD_UNIT"),
+		Identifier: field("SYSLOG_IDENTIFIER"),
+		BootId:     field("_BOOT_ID"),
+		Message:    journalMessage(fields["MESSAGE"]),
+	}
+
+	if micros, err := strconv.ParseInt(field("__REALTIME_TIMESTAMP"), 10, 64); err == nil {
+		entry.Timestamp = time.Unix(0, micros*int64(time.Microsecond)).UTC()
+	}
+	entry.Priority, _ = strconv.Atoi(field("PRIORITY"))
+	entry.Pid, _ = strconv.Atoi(field("_PID"))
+
+	return entry, nil
+}
+
+func journalCommand(query *JournalQuery) string {
+	parts := []string{"journalctl", "--no-pager", "--output=json", "--unit", shellQuote(query.Unit)}
+
+	if query.Cursor != "" {
+		parts = append(parts, "--after-cursor", shellQuote(query.Cursor))
+	}
+	if query.Since != "" {
+		parts = append(parts, "--since", shellQuote(query.Since))
+	}
+	if query.Until != "" {
+		parts = append(parts, "--until", shellQuote(query.Until))
+	}
+	if query.Lines > 0 {
+		parts = append(parts, "--lines", strconv.Itoa(query.Lines))
+	}
+	if query.Priority != "" {
+		parts = append(parts, "--priority", shellQuote(query.Priority))
+	}
+	if query.Follow {
+		parts = append(parts, "--follow")
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func (conn *SshConnection) readJournal(ctx context.Context, query *JournalQuery) (*JournalResponse, error) {
+	res, err := conn.RunCommand(ctx, journalCommand(query))
+	if err != nil {
+		return nil, err
+	} else if res.Error != "" {
+		return nil, fmt.Errorf("journalctl %s", res.Error)
+	} else if res.Code != 0 {
+		return nil, fmt.Errorf("journalctl exited with %d: %s", res.Code, bytes.TrimSpace(res.Stderr))
+	}
+
+	response := JournalResponse{
+		Entries: make([]JournalEntry, 0),
+		Cursor:  query.Cursor,
+	}
+
+	for _, line := range bytes.Split(res.Stdout, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		entry, err := parseJournalEntry(line)
+		if err != nil {
+			return nil, err
+		}
+
+		response.Entries = append(response.Entries, entry)
+		response.Cursor = entry.Cursor
+	}
+
+	return &response, nil
+}
+
+// followJournal streams entries as they are written, each event carries the cursor of its entry as the id
+func (conn *SshConnection) followJournal(ctx context.Context, query *JournalQuery, events chan<- SseEvent) error {
+	output := make(chan CommandStreamEvent)
+	streamErr := make(chan error, 1)
+	go func() {
+		defer close(output)
+		streamErr <- conn.StreamCommand(ctx, journalCommand(query), output)
+	}()
+
+	var pending []byte
+	var stderr []byte
+	var exit CommandStreamEvent
+	for event := range output {
+		switch event.Type {
+		case "stderr":
+			stderr = append(stderr, event.Data...)
+		case "exit":
+			exit = event
+		case "stdout":
+			// Output arrives in chunks, only complete lines are parsed
+			pending = append(pending, event.Data...)
+			for {
+				end := bytes.IndexByte(pending, '\n')
+				if end < 0 {
+					break
+				}
+
+				line := pending[:end]
+				pending = pending[end+1:]
+				if len(bytes.TrimSpace(line)) == 0 {
+					continue
+				}
+
+				entry, err := parseJournalEntry(line)
+				if err != nil {
+					log.Printf("Skipping journal entry because %s", err)
+					continue
+				}
+
+				entryOut, _ := json.Marshal(entry)
+				select {
+				case events <- SseEvent{Id: entry.Cursor, Data: string(entryOut)}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	}
+
+	if err := <-streamErr; err != nil {
+		return err
+	} else if exit.Error != "" {
+		return fmt.Errorf("journalctl failed: %s", exit.Error)
+	} else if exit.Code != 0 {
+		return fmt.Errorf("journalctl exited with %d: %s", exit.Code, bytes.TrimSpace(stderr))
+	}
+
+	return nil
+}
+
+func readJournalQuery(ctx iris.Context) (*JournalQuery, bool) {
+	query := JournalQuery{
+		Unit:     ctx.URLParam("id"),
+		Cursor:   ctx.URLParam("cursor"),
+		Since:    ctx.URLParam("since"),
+		Until:    ctx.URLParam("until"),
+		Priority: ctx.URLParam("priority"),
+	}
+	query.Follow, _ = ctx.URLParamBool("follow")
+
+	// EventSource sends the id of the last event it received when it reconnects
+	if lastEventId := ctx.GetHeader("Last-Event-ID"); lastEventId != "" {
+		query.Cursor = lastEventId
+	}
+
+	if query.Unit == "" {
+		ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+			Title("Missing unit").
+			Type("systemd_logs").
+			Detail("id is required"))
+		return nil, false
+	}
+
+	query.Lines = ctx.URLParamIntDefault("lines", 0)
+	if query.Lines < 0 || query.Lines > maxJournalLines {
+		ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+			Title("Invalid line limit").
+			Type("systemd_logs").
+			Detail(fmt.Sprintf("lines has to be between 0 and %d", maxJournalLines)))
+		return nil, false
+	}
+
+	// Without a starting point the whole journal of the unit would be read
+	if query.Lines == 0 && !query.Follow && query.Cursor == "" && query.Since == "" {
+		query.Lines = defaultJournalLines
+	}
+
+	return &query, true
+}
+
+func SystemdServiceLogsRoute(app *iris.Application) {
+	app.Get("/systemd/service/logs", func(ctx iris.Context) {
+		query, ok := readJournalQuery(ctx)
+		if !ok {
+			return
+		}
+
+		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
+			return
+		}
+		defer handle.Close()
+
+		log.Printf("Reading journal of %s", query.Unit)
+
+		if !query.Follow {
+			response, err := handle.conn.readJournal(ctx.Request().Context(), query)
+			if err != nil {
+				ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+					Title("Reading journal failed").
+					Type("systemd_logs").
+					DetailErr(err)))
+				return
+			}
+
+			ctx.JSON(response)
+			return
+		}
+
+		events := make(chan SseEvent)
+		go (func() {
+			defer close(events)
+
+			err := handle.conn.followJournal(ctx.Request().Context(), query, events)
+			if err != nil && ctx.Request().Context().Err() == nil {
+				log.Printf("Following journal of %s failed because %s\n", query.Unit, err)
+				lineOut, _ := json.Marshal(handle.problem(iris.NewProblem().
+					Title("Error reading journal").
+					Type("stream_err").
+					DetailErr(err)))
+				select {
+				case events <- SseEvent{Data: string(lineOut)}:
+				case <-ctx.Request().Context().Done():
+				}
+			}
+		})()
+
+		sseEvents(ctx, events)
+	}).SetName("Systemd service logs")
+}
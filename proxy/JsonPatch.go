@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// JsonPatchOperation is a single RFC 6902 operation
+type JsonPatchOperation struct {
+	Op    string      `json:"op"` // add, remove, replace
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// toJsonDocument round trips value through JSON so that it can be compared structurally
+func toJsonDocument(value interface{}) (interface{}, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var document interface{}
+	if err := json.Unmarshal(raw, &document); err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+func escapeJsonPointer(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+// diffJsonDocuments creates a patch that transforms from into to. Both are expected to be produced by toJsonDocument.
+// Objects are diffed key by key while arrays that differ are replaced as a whole.
+func diffJsonDocuments(path string, from interface{}, to interface{}) []JsonPatchOperation {
+	fromMap, fromIsMap := from.(map[string]interface{})
+	toMap, toIsMap := to.(map[string]interface{})
+
+	if !fromIsMap || !toIsMap {
+		if reflect.DeepEqual(from, to) {
+			return nil
+		}
+
+		return []JsonPatchOperation{{Op: "replace", Path: path, Value: to}}
+	}
+
+	keys := make([]string, 0, len(fromMap)+len(toMap))
+	for key := range fromMap {
+		keys = append(keys, key)
+	}
+	for key := range toMap {
+		if _, ok := fromMap[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var patch []JsonPatchOperation
+	for _, key := range keys {
+		childPath := path + "/" + escapeJsonPointer(key)
+		fromValue, inFrom := fromMap[key]
+		toValue, inTo := toMap[key]
+
+		switch {
+		case inFrom && !inTo:
+			patch = append(patch, JsonPatchOperation{Op: "remove", Path: childPath})
+		case !inFrom && inTo:
+			patch = append(patch, JsonPatchOperation{Op: "add", Path: childPath, Value: toValue})
+		default:
+			patch = append(patch, diffJsonDocuments(childPath, fromValue, toValue)...)
+		}
+	}
+
+	return patch
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"github.com/kataras/iris/v12"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"strconv"
+)
+
+const metricsNamespace = "supercompose_proxy"
+
+var (
+	sshConnectDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "ssh_connect_duration_seconds",
+		Help:      "Time it takes to dial, authenticate and initialize an SSH connection.",
+		Buckets:   []float64{.1, .25, .5, 1, 2.5, 5, 10, 30},
+	})
+
+	sshConnectFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ssh_connect_failures_total",
+		Help:      "Number of SSH connections that could not be established.",
+	})
+
+	commandDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "command_duration_seconds",
+		Help:      "Duration of shell commands.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+	})
+
+	commandExits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "command_exits_total",
+		Help:      "Number of finished shell commands by exit code, or timeout, cancelled and error when there is none.",
+	}, []string{"code"})
+
+	sseStreams = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "sse_streams_open",
+		Help:      "Number of currently open server sent event streams.",
+	})
+
+	fileBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "file_bytes_total",
+		Help:      "Bytes read and written by the file routes.",
+	}, []string{"direction"})
+)
+
+// connectionManagerCollector reports the state of the connection pool at scrape time
+type connectionManagerCollector struct {
+	connections *prometheus.Desc
+	handles     *prometheus.Desc
+}
+
+func (c *connectionManagerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.connections
+	ch <- c.handles
+}
+
+func (c *connectionManagerCollector) Collect(ch chan<- prometheus.Metric) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	handles := make(map[string]int)
+	for _, element := range manager.connections {
+		handles[element.conn.id] += element.handles
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.connections, prometheus.GaugeValue, float64(len(manager.connections)))
+	for host, count := range handles {
+		ch <- prometheus.MustNewConstMetric(c.handles, prometheus.GaugeValue, float64(count), host)
+	}
+}
+
+func init() {
+	prometheus.MustRegister(&connectionManagerCollector{
+		connections: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "pooled_connections"),
+			"Number of SSH connections held by the connection manager.",
+			nil, nil,
+		),
+		handles: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "connection_handles"),
+			"Number of open handles per pooled SSH connection.",
+			[]string{"host"}, nil,
+		),
+	})
+}
+
+func observeCommand(result *CommandResult, seconds float64) {
+	commandDuration.Observe(seconds)
+
+	if result == nil {
+		commandExits.WithLabelValues("error").Inc()
+	} else if result.Error != "" {
+		commandExits.WithLabelValues(result.Error).Inc()
+	} else {
+		commandExits.WithLabelValues(strconv.Itoa(result.Code)).Inc()
+	}
+}
+
+func metricsRoute(app *iris.Application) {
+	app.Get("/metrics", iris.FromStd(promhttp.Handler())).SetName("Metrics")
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTooManyStreams is returned when every slot that long-lived sessions may hold is taken
+var ErrTooManyStreams = errors.New("too many open shells and streams")
+
+// streamLimit is how many of limit session slots long-lived sessions may hold, RESERVED_COMMAND_SESSIONS are kept
+// free for commands so that shells and followed logs can not block them
+func streamLimit(limit int) int {
+	reserved := viper.GetInt("RESERVED_COMMAND_SESSIONS")
+	if reserved < 0 {
+		reserved = 0
+	}
+
+	if limit-reserved < 1 {
+		return 1
+	}
+
+	return limit - reserved
+}
+
+// newStreamSlots limits the long-lived sessions of a connection
+func newStreamSlots() chan struct{} {
+	return make(chan struct{}, streamLimit(viper.GetInt("CONNECTION_MAX_SESSIONS")))
+}
+
+// sessionClient is an SSH client together with slots for the sessions that are open on it, so that the proxy stays
+// below the MaxSessions of the server instead of failing with "open failed"
+type sessionClient struct {
+	client *ssh.Client
+	slots  chan struct{}
+	// jumpHandle keeps the bastion alive for overflow clients, the primary client releases it with the connection
+	jumpHandle *ConnectionHandle
+	// lost is closed once an overflow client ends or stops answering keepalives, the primary client is watched
+	// through its connection instead
+	lost     chan struct{}
+	lostOnce sync.Once
+	lostErr  error
+}
+
+func newSessionClient(client *ssh.Client, jumpHandle *ConnectionHandle) *sessionClient {
+	limit := viper.GetInt("CONNECTION_MAX_SESSIONS")
+	if limit < 1 {
+		limit = 1
+	}
+
+	return &sessionClient{
+		client:     client,
+		slots:      make(chan struct{}, limit),
+		jumpHandle: jumpHandle,
+		lost:       make(chan struct{}),
+	}
+}
+
+func (sessions *sessionClient) markLost(err error) {
+	sessions.lostOnce.Do(func() {
+		sessions.lostErr = err
+		close(sessions.lost)
+	})
+}
+
+func (sessions *sessionClient) Close() error {
+	err := sessions.client.Close()
+	if sessions.jumpHandle != nil {
+		sessions.jumpHandle.Close()
+	}
+
+	return err
+}
+
+// dialSessionClient returns a dialer for additional clients to the host, with agent forwarding if it is requested.
+// The credentials are copied so that the dialer does not depend on the request they came from.
+func dialSessionClient(args *SshConnectionCredentials) func(ctx context.Context) (*ssh.Client, *ConnectionHandle, error) {
+	credentials := *args
+
+	return func(ctx context.Context) (*ssh.Client, *ConnectionHandle, error) {
+		sshClient, jumpHandle, err := dialHost(ctx, &credentials)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if credentials.ForwardAgent {
+			if err := forwardAgent(sshClient, &credentials); err != nil {
+				sshClient.Close()
+				if jumpHandle != nil {
+					jumpHandle.Close()
+				}
+				return nil, nil, err
+			}
+		}
+
+		return sshClient, jumpHandle, nil
+	}
+}
+
+// openOverflow opens the second client to the host unless it is already open, it is closed together with the
+// connection or dropped when it is lost
+func (conn *SshConnection) openOverflow(ctx context.Context) error {
+	return conn.overflowInit.Do(func() error {
+		// Close marks the connection lost before it closes the overflow client, which it does under overflowInit.mu
+		if conn.isLost() {
+			return conn.lostErr
+		}
+
+		_, span := sshTracer.Start(ctx, fmt.Sprintf("Opening overflow connection to %s", conn.id))
+		defer span.End()
+
+		sshClient, jumpHandle, err := conn.dial(ctx)
+		if err != nil {
+			span.RecordError(err)
+			return err
+		}
+
+		log.Printf("Opened overflow connection to %s because %d sessions are waiting", conn.id, atomic.LoadInt32(&conn.waitingSessions))
+		overflow := newSessionClient(sshClient, jumpHandle)
+
+		conn.overflowMu.Lock()
+		conn.overflow = overflow
+		conn.overflowMu.Unlock()
+
+		go conn.watchOverflow(overflow, viper.GetDuration("KEEPALIVE_INTERVAL"), viper.GetInt("KEEPALIVE_MAX_MISSED"))
+		return nil
+	})
+}
+
+// watchOverflow runs keepalives on the overflow client and drops it once it is lost, so that it is opened again the
+// next time sessions queue up
+func (conn *SshConnection) watchOverflow(overflow *sessionClient, interval time.Duration, maxMissed int) {
+	keepAlive(overflow.client, conn.id, interval, maxMissed, overflow.lost, overflow.markLost)
+	<-overflow.lost
+
+	conn.overflowInit.reset(func() bool {
+		conn.overflowMu.Lock()
+		defer conn.overflowMu.Unlock()
+
+		if conn.overflow != overflow {
+			return false
+		}
+
+		log.Printf("Dropping overflow connection to %s because %s", conn.id, overflow.lostErr)
+		conn.overflow = nil
+		return true
+	})
+
+	overflow.Close()
+}
+
+// currentOverflow returns the overflow client if it is open
+func (conn *SshConnection) currentOverflow() *sessionClient {
+	conn.overflowMu.Lock()
+	defer conn.overflowMu.Unlock()
+
+	return conn.overflow
+}
+
+// acquireSessionClient takes a session slot on the connection or its overflow client, waiting for one when all are
+// taken. When OVERFLOW_QUEUE_LENGTH requests are waiting, the overflow client is opened.
+func (conn *SshConnection) acquireSessionClient(ctx context.Context) (*sessionClient, error) {
+	var overflowSlots chan struct{}
+	overflow := conn.currentOverflow()
+	if overflow != nil {
+		overflowSlots = overflow.slots
+	}
+
+	select {
+	case conn.sessions.slots <- struct{}{}:
+		return conn.sessions, nil
+	case overflowSlots <- struct{}{}:
+		return overflow, nil
+	default:
+	}
+
+	waiting := atomic.AddInt32(&conn.waitingSessions, 1)
+	defer atomic.AddInt32(&conn.waitingSessions, -1)
+
+	if threshold := viper.GetInt("OVERFLOW_QUEUE_LENGTH"); threshold > 0 && int(waiting) >= threshold && conn.dial != nil {
+		if err := conn.openOverflow(ctx); err != nil {
+			log.Printf("Failed to open overflow connection to %s because %s", conn.id, err)
+		} else if overflow = conn.currentOverflow(); overflow != nil {
+			overflowSlots = overflow.slots
+		}
+	}
+
+	log.Printf("Waiting for a free session on %s", conn.id)
+	select {
+	case conn.sessions.slots <- struct{}{}:
+		return conn.sessions, nil
+	case overflowSlots <- struct{}{}:
+		return overflow, nil
+	case <-conn.lost:
+		return nil, conn.lostErr
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// openSessions is the number of sessions currently open on the connection and its overflow client
+func (conn *SshConnection) openSessions() int {
+	if conn.sessions == nil {
+		return 0
+	}
+
+	open := len(conn.sessions.slots)
+	if overflow := conn.currentOverflow(); overflow != nil {
+		open += len(overflow.slots)
+	}
+
+	return open
+}
+
+// sshSession is a session that holds its host and client slots until it is closed
+type sshSession struct {
+	*ssh.Session
+	release func()
+}
+
+func (session *sshSession) Close() error {
+	defer session.release()
+	return session.Session.Close()
+}
+
+// newSession opens a session with agent forwarding once the host and the connection have a free session slot,
+// waiting for one if needed
+func (conn *SshConnection) newSession(ctx context.Context) (*sshSession, error) {
+	releaseHost, err := acquireHostSession(ctx, conn.host)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := conn.acquireSessionClient(ctx)
+	if err != nil {
+		releaseHost()
+		return nil, err
+	}
+
+	var releaseOnce sync.Once
+	release := func() {
+		releaseOnce.Do(func() {
+			<-sessions.slots
+			releaseHost()
+		})
+	}
+
+	session, err := sessions.client.NewSession()
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	if err := conn.requestAgentForwarding(session); err != nil {
+		session.Close()
+		release()
+		return nil, err
+	}
+
+	return &sshSession{Session: session, release: release}, nil
+}
+
+// newStreamSession opens a session for a shell or a stream that stays open for as long as the client wants. It fails
+// right away when the stream slots of the connection or host are taken instead of waiting for one to be released.
+func (conn *SshConnection) newStreamSession(ctx context.Context) (*sshSession, error) {
+	releaseHostStream, err := acquireHostStream(conn.host)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case conn.streams <- struct{}{}:
+	default:
+		releaseHostStream()
+		return nil, fmt.Errorf("%w on %s", ErrTooManyStreams, conn.id)
+	}
+
+	releaseStream := func() {
+		<-conn.streams
+		releaseHostStream()
+	}
+
+	session, err := conn.newSession(ctx)
+	if err != nil {
+		releaseStream()
+		return nil, err
+	}
+
+	var releaseOnce sync.Once
+	releaseSession := session.release
+	session.release = func() {
+		releaseOnce.Do(func() {
+			releaseSession()
+			releaseStream()
+		})
+	}
+
+	return session, nil
+}
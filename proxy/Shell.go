@@ -1,25 +1,88 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/kataras/iris/v12"
 	"github.com/kataras/iris/v12/middleware/jwt"
 	"go.opentelemetry.io/otel"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	"io"
 	"log"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
+const defaultCommandTimeout = 30 * time.Second
+const maxCommandTimeout = 1 * time.Hour
+
+// terminationGracePeriod is how long a command gets to exit after each signal before we escalate
+const terminationGracePeriod = 5 * time.Second
+
+func (conn *SshConnection) requestAgentForwarding(session *ssh.Session) error {
+	if !conn.forwardAgent {
+		return nil
+	}
+
+	if err := agent.RequestAgentForwarding(session); err != nil {
+		return fmt.Errorf("failed to request agent forwarding: %w", err)
+	}
+
+	return nil
+}
+
+// shellQuote wraps value in single quotes so that it is passed to the remote shell as a single literal argument
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'"'"'`) + "'"
+}
+
 func (conn *SshConnection) RunCommand(ctx context.Context, cmd string) (*CommandResult, error) {
+	return conn.RunCommandWithTimeout(ctx, cmd, defaultCommandTimeout)
+}
+
+// terminateSession sends SIGTERM, then SIGKILL and finally tears the session down, waiting for the command to exit
+// after each step. Returns the last signal sent, whether the command exited and the result of session.Wait.
+func terminateSession(session *ssh.Session, cWait chan error) (ssh.Signal, bool, error) {
+	for _, signal := range []ssh.Signal{ssh.SIGTERM, ssh.SIGKILL} {
+		if err := session.Signal(signal); err != nil {
+			log.Printf("Failed to send %s to session because %s\n", signal, err)
+		}
+
+		select {
+		case err := <-cWait:
+			return signal, true, err
+		case <-time.After(terminationGracePeriod):
+		}
+	}
+
+	session.Close()
+
+	select {
+	case err := <-cWait:
+		return ssh.SIGKILL, true, err
+	case <-time.After(terminationGracePeriod):
+		return ssh.SIGKILL, false, nil
+	}
+}
+
+func (conn *SshConnection) RunCommandWithTimeout(ctx context.Context, cmd string, timeout time.Duration) (result *CommandResult, err error) {
 	log.Printf("Running '%s' on %s\n", cmd, conn.id)
 
+	start := time.Now()
+	defer func() {
+		observeCommand(result, time.Since(start).Seconds())
+	}()
+
 	_, span := otel.Tracer("shell").Start(ctx, fmt.Sprintf("Command: %s", cmd))
 	defer span.End()
 
 	span.AddEvent("Creating session")
-	session, err := conn.client.NewSession()
+	session, err := conn.newSession(ctx)
 	if err != nil {
 		span.RecordError(err)
 		log.Printf("Failed to create session on because %s\n", err)
@@ -27,12 +90,149 @@ func (conn *SshConnection) RunCommand(ctx context.Context, cmd string) (*Command
 	}
 	defer session.Close()
 
+	// Output is collected concurrently so that commands with large output do not block on a full channel window
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	span.AddEvent("Starting session")
+	err = session.Start(cmd)
+	if err != nil {
+		span.RecordError(err)
+		log.Printf("Failed to start session on %s\n", conn.id)
+		return nil, err
+	}
+
+	cWait := make(chan error, 1)
+	go func() {
+		cWait <- session.Wait()
+	}()
+
+	result = &CommandResult{
+		Cmd: cmd,
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	exited := true
+	select {
+	case err = <-cWait:
+		break
+	case <-timer.C:
+		span.AddEvent("Timed out")
+		result.Error = "timeout"
+	case <-ctx.Done():
+		span.AddEvent("Cancelled")
+		result.Error = "cancelled"
+	}
+
+	if result.Error != "" {
+		var signal ssh.Signal
+		signal, exited, err = terminateSession(session.Session, cWait)
+		result.Signal = string(signal)
+		log.Printf("Command %s on %s was terminated with %s after %s\n", cmd, conn.id, signal, result.Error)
+	}
+
+	if err != nil {
+		switch v := err.(type) {
+		case *ssh.ExitError:
+			span.AddEvent("Exit")
+			result.Code = v.Waitmsg.ExitStatus()
+		case *ssh.ExitMissingError:
+			span.AddEvent("Exit missing")
+		default:
+			span.RecordError(err)
+			log.Printf("Failed run Command %s on %s because %s\n", cmd, conn.id, err)
+			if result.Error == "" {
+				result = nil
+				return nil, err
+			}
+		}
+	}
+
+	// Buffers are only safe to read once Wait has returned and the copying goroutines are done
+	if exited {
+		result.Stdout = stdout.Bytes()
+		result.Stderr = stderr.Bytes()
+	}
+
+	return result, nil
+}
+
+type CommandStreamEvent struct {
+	Type  string `json:"type"` // stdout, stderr, exit
+	Data  string `json:"data,omitempty"`
+	Code  int    `json:"code"`
+	Error string `json:"error,omitempty"`
+}
+
+// incompleteRuneStart returns where a multi-byte rune that is cut off at the end of data starts, or len(data)
+func incompleteRuneStart(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return i
+			}
+			break
+		}
+	}
+
+	return len(data)
+}
+
+func pipeCommandOutput(ctx context.Context, eventType string, reader io.Reader, events chan<- CommandStreamEvent) error {
+	buf := make([]byte, 4096)
+	pending := 0
+	for {
+		n, err := reader.Read(buf[pending:])
+		n += pending
+
+		// A rune split across reads is held back, otherwise it would be replaced when the event is marshalled
+		end := n
+		if err == nil {
+			end = incompleteRuneStart(buf[:n])
+		}
+
+		if end > 0 {
+			select {
+			case events <- CommandStreamEvent{Type: eventType, Data: string(buf[:end])}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		pending = copy(buf, buf[end:n])
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// StreamCommand runs cmd and emits stdout and stderr chunks as they arrive, followed by a single exit event
+func (conn *SshConnection) StreamCommand(ctx context.Context, cmd string, events chan<- CommandStreamEvent) error {
+	log.Printf("Streaming '%s' on %s\n", cmd, conn.id)
+
+	_, span := otel.Tracer("shell").Start(ctx, fmt.Sprintf("Stream command: %s", cmd))
+	defer span.End()
+
+	span.AddEvent("Creating session")
+	session, err := conn.newStreamSession(ctx)
+	if err != nil {
+		span.RecordError(err)
+		log.Printf("Failed to create session on because %s\n", err)
+		return err
+	}
+	defer session.Close()
+
 	span.AddEvent("Creating stdout pipe")
 	outPipe, err := session.StdoutPipe()
 	if err != nil {
 		span.RecordError(err)
 		log.Printf("Failed to open stdout on %s because %s\n", conn.id, err)
-		return nil, err
+		return err
 	}
 
 	span.AddEvent("Creating stderr pipe")
@@ -40,95 +240,146 @@ func (conn *SshConnection) RunCommand(ctx context.Context, cmd string) (*Command
 	if err != nil {
 		span.RecordError(err)
 		log.Printf("Failed to open stderr on %s because %s\n", conn.id, err)
-		return nil, err
+		return err
 	}
 
 	span.AddEvent("Starting session")
-	err = session.Start(cmd)
-	if err != nil {
+	if err := session.Start(cmd); err != nil {
 		span.RecordError(err)
 		log.Printf("Failed to start session on %s\n", conn.id)
-		return nil, err
+		return err
 	}
 
-	cWait := make(chan error)
+	// Closing the session unblocks the pipes when the client goes away
 	go func() {
-		err = session.Wait()
-		cWait <- err
+		<-ctx.Done()
+		session.Close()
 	}()
 
-	result := CommandResult{
-		Cmd: cmd,
-	}
+	outDone := make(chan error, 1)
+	go func() {
+		outDone <- pipeCommandOutput(ctx, "stdout", outPipe, events)
+	}()
 
-	select {
-	case err = <-cWait:
-		{
-			if err != nil {
-				switch v := err.(type) {
-				case *ssh.ExitError:
-					span.AddEvent("Exit")
-					result.Code = v.Waitmsg.ExitStatus()
-					break
-				default:
-					span.RecordError(err)
-					log.Printf("Failed run Command %s on %s because %s\n", cmd, conn.id, err)
-					return nil, err
-				}
-			}
-			break
+	errDone := make(chan error, 1)
+	go func() {
+		errDone <- pipeCommandOutput(ctx, "stderr", errPipe, events)
+	}()
+
+	outErr := <-outDone
+	errErr := <-errDone
+
+	exit := CommandStreamEvent{Type: "exit"}
+	if err := session.Wait(); err != nil {
+		switch v := err.(type) {
+		case *ssh.ExitError:
+			span.AddEvent("Exit")
+			exit.Code = v.Waitmsg.ExitStatus()
+		default:
+			span.RecordError(err)
+			log.Printf("Failed run Command %s on %s because %s\n", cmd, conn.id, err)
+			exit.Error = err.Error()
 		}
-	case <-time.After(30 * time.Second):
-		span.AddEvent("Timed out")
-		result.Error = "timeout"
-		return &result, nil
+	} else if outErr != nil {
+		exit.Error = outErr.Error()
+	} else if errErr != nil {
+		exit.Error = errErr.Error()
 	}
 
-	span.AddEvent("Reading stdout")
-	stdout, outReadErr := io.ReadAll(outPipe)
-	if outReadErr != nil {
-		span.RecordError(outReadErr)
-		log.Printf("Failed to read output for Command %s on %s because %s.\n", cmd, conn.id, outReadErr)
-		return nil, outReadErr
+	if ctx.Err() != nil {
+		return ctx.Err()
 	}
 
-	span.AddEvent("Reading stderr")
-	stderr, errReadErr := io.ReadAll(errPipe)
-	if errReadErr != nil {
-		span.RecordError(errReadErr)
-		log.Printf("Failed to read output for Command %s on %s because %s.\n", cmd, conn.id, errReadErr)
-		return nil, errReadErr
+	select {
+	case events <- exit:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return nil
+}
+
+// readCommandTimeout reads the timeout parameter in seconds, it stops the request when the value is invalid
+func readCommandTimeout(ctx iris.Context, defaultTimeout time.Duration) (time.Duration, bool) {
+	param := ctx.URLParam("timeout")
+	if param == "" {
+		return defaultTimeout, true
 	}
 
-	result.Stdout = stdout
-	result.Stderr = stderr
+	seconds, err := strconv.Atoi(param)
+	if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > maxCommandTimeout {
+		ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+			Title("Invalid timeout").
+			Type("invalid_timeout").
+			Detail(fmt.Sprintf("timeout must be a number of seconds between 1 and %d", int(maxCommandTimeout.Seconds()))))
+		return 0, false
+	}
 
-	return &result, nil
+	return time.Duration(seconds) * time.Second, true
 }
 
 func commandRoute(app *iris.Application) {
 	app.Get("/command", func(ctx iris.Context) {
+		timeout, ok := readCommandTimeout(ctx, defaultCommandTimeout)
+		if !ok {
+			return
+		}
+
 		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
 		if err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
-				Title("Connection to target host failed").
-				Type("connection_err").
-				DetailErr(err))
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
 			return
 		}
 		defer handle.Close()
 
-		out, err := handle.conn.RunCommand(ctx.Request().Context(), ctx.URLParam("command"))
+		out, err := handle.conn.RunCommandWithTimeout(ctx.Request().Context(), ctx.URLParam("command"), timeout)
 
 		if err != nil {
 			ctx.StopWithError(iris.StatusUnprocessableEntity, err)
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
 				Title("Command failed").
 				Type("command_err").
-				DetailErr(err))
+				DetailErr(err)))
 			return
 		}
 
 		ctx.JSON(out)
 	}).SetName("Command")
 }
+
+func commandStreamRoute(app *iris.Application) {
+	app.Get("/command/stream", func(ctx iris.Context) {
+		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
+			return
+		}
+		defer handle.Close()
+
+		events := make(chan CommandStreamEvent)
+		go func() {
+			defer close(events)
+
+			err := handle.conn.StreamCommand(ctx.Request().Context(), ctx.URLParam("command"), events)
+			if err != nil && ctx.Request().Context().Err() == nil {
+				log.Printf("Streaming command failed because %s\n", err)
+				events <- CommandStreamEvent{Type: "exit", Error: err.Error()}
+			}
+		}()
+
+		lines := make(chan string)
+		go (func() {
+			defer close(lines)
+
+			for event := range events {
+				lineOut, _ := json.Marshal(event)
+				select {
+				case lines <- string(lineOut):
+				case <-ctx.Request().Context().Done():
+				}
+			}
+		})()
+
+		sse(ctx, lines)
+	}).SetName("Command stream")
+}
@@ -2,16 +2,24 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	systemdDbus "github.com/coreos/go-systemd/dbus"
 	"github.com/docker/docker/client"
+	"github.com/kataras/iris/v12"
 	"github.com/pkg/sftp"
 	"go.opentelemetry.io/otel"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	"io"
 	"log"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,12 +28,44 @@ type SshConnectionCredentials struct {
 	Username string `json:"username" validate:"required"`
 	Pkey     string `json:"pkey"`
 	Password string `json:"password"`
+	// HostKey pins the expected host key, either in authorized_keys format or as a SHA256 fingerprint
+	HostKey string `json:"host_key"`
+	// HostKeyMode is one of tofu, strict or insecure and defaults to HOST_KEY_MODE
+	HostKeyMode string `json:"host_key_mode"`
+	// Passphrase decrypts Pkey when it is encrypted
+	Passphrase string `json:"passphrase"`
+	// Certificate is an OpenSSH user certificate signed for Pkey, in authorized_keys format
+	Certificate string `json:"certificate"`
+	// InteractiveAnswers answers keyboard interactive prompts by the longest matching prompt prefix, hidden prompts default to Password
+	InteractiveAnswers map[string]string `json:"interactive_answers"`
+	// ForwardAgent exposes Pkey to commands on the host through a forwarded SSH agent
+	ForwardAgent bool `json:"forward_agent"`
+	// JumpHosts are bastions to tunnel through in order, the first one is dialed directly
+	JumpHosts []SshConnectionCredentials `json:"jump_hosts"`
+}
+
+// key identifies credentials in the connection pool, credentials are hashed so that secrets are not kept twice
+func (args *SshConnectionCredentials) key() string {
+	serialized, _ := json.Marshal(args)
+	hash := sha256.Sum256(serialized)
+	return hex.EncodeToString(hash[:])
+}
+
+// jumpHost returns the last jump host with the rest of the chain as its own jump hosts
+func (args *SshConnectionCredentials) jumpHost() *SshConnectionCredentials {
+	if len(args.JumpHosts) == 0 {
+		return nil
+	}
+
+	jump := args.JumpHosts[len(args.JumpHosts)-1]
+	jump.JumpHosts = args.JumpHosts[:len(args.JumpHosts)-1]
+	return &jump
 }
 
 type SshConnection struct {
 	io.Closer
 	id            string
-	args          SshConnectionCredentials
+	host          string
 	client        *ssh.Client
 	sftpClient    *sftp.Client
 	shellSession  *ssh.Session
@@ -33,75 +73,420 @@ type SshConnection struct {
 	dockerClient  *client.Client
 	uid           int
 	systemdHandle *systemdDbus.Conn
+	systemdInit   lazyInit
+	// systemdEvents is the unit state change feed shared by all event streams
+	systemdEvents     *SystemdEvents
+	systemdEventsInit lazyInit
+	// composeCommand is either "docker compose" or "docker-compose", detected on first use
+	composeCommand string
+	composeInit    lazyInit
+	dockerStateMu  sync.Mutex
+	dockerState    *DockerState
+	// jumpHandle keeps the bastion connection this connection is tunnelled through alive
+	jumpHandle *ConnectionHandle
+	// forwardAgent requests agent forwarding on every session
+	forwardAgent bool
+	// sessions limits the sessions opened on client, overflow is a second client to the host that is opened when
+	// too many sessions are waiting, dial opens it. overflow is dropped when it is lost and opened again on demand,
+	// it is written under overflowInit.mu and overflowMu and read with currentOverflow.
+	sessions        *sessionClient
+	overflow        *sessionClient
+	overflowInit    lazyInit
+	overflowMu      sync.Mutex
+	waitingSessions int32
+	dial            func(ctx context.Context) (*ssh.Client, *ConnectionHandle, error)
+	// streams limits the long-lived sessions across both clients, see newStreamSession
+	streams chan struct{}
+	// lost is closed once the connection is closed or detected dead, lostErr tells why
+	lost     chan struct{}
+	lostOnce sync.Once
+	lostErr  error
+}
+
+// lazyInit runs an initializer until it succeeds once. Concurrent callers wait for the running attempt instead of
+// starting their own, and unlike sync.Once a failed attempt is retried by the next caller.
+type lazyInit struct {
+	mu   sync.Mutex
+	done uint32
+}
+
+func (lazy *lazyInit) Do(f func() error) error {
+	if atomic.LoadUint32(&lazy.done) == 1 {
+		return nil
+	}
+
+	lazy.mu.Lock()
+	defer lazy.mu.Unlock()
+
+	if lazy.done == 0 {
+		if err := f(); err != nil {
+			return err
+		}
+
+		atomic.StoreUint32(&lazy.done, 1)
+	}
+
+	return nil
 }
 
+// reset lets the next Do run the initializer again when discard reports that the initialized value was dropped.
+// discard runs while no attempt is running.
+func (lazy *lazyInit) reset(discard func() bool) {
+	lazy.mu.Lock()
+	defer lazy.mu.Unlock()
+
+	if discard() {
+		atomic.StoreUint32(&lazy.done, 0)
+	}
+}
+
+// initialized reports whether an initializer has succeeded, it never waits for a running one
+func (lazy *lazyInit) initialized() bool {
+	return atomic.LoadUint32(&lazy.done) == 1
+}
+
+var ErrConnectionLost = errors.New("connection lost")
+
 type CommandResult struct {
 	Cmd    string `json:"command"`
 	Stdout []byte `json:"stdout"`
 	Stderr []byte `json:"stderr"`
 	Code   int    `json:"code"`
-	Error  string `json:"error"`
+	Error  string `json:"error"`  // timeout or cancelled when the command did not finish on its own
+	Signal string `json:"signal"` // last signal sent to terminate the command
+}
+
+// markLost records why the connection stopped being usable, only the first reason is kept
+func (conn *SshConnection) markLost(err error) {
+	conn.lostOnce.Do(func() {
+		conn.lostErr = fmt.Errorf("%w: %v", ErrConnectionLost, err)
+		close(conn.lost)
+	})
+}
+
+func (conn *SshConnection) isLost() bool {
+	select {
+	case <-conn.lost:
+		return true
+	default:
+		return false
+	}
+}
+
+// watchConnection marks the connection lost when the underlying SSH connection ends or stops answering keepalives
+func (conn *SshConnection) watchConnection(interval time.Duration, maxMissed int) {
+	keepAlive(conn.client, conn.id, interval, maxMissed, conn.lost, conn.markLost)
+}
+
+// keepAlive calls markLost when client ends or stops answering keepalives, it returns once lost is closed
+func keepAlive(client *ssh.Client, id string, interval time.Duration, maxMissed int, lost <-chan struct{}, markLost func(err error)) {
+	go func() {
+		err := client.Wait()
+		if err == nil {
+			err = io.EOF
+		}
+		markLost(err)
+	}()
+
+	// A zero interval disables keepalives, the connection is then only marked lost when it ends
+	if interval <= 0 {
+		return
+	}
+	if maxMissed < 1 {
+		maxMissed = 1
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	missed := 0
+	for {
+		select {
+		case <-lost:
+			return
+		case <-ticker.C:
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		select {
+		case <-lost:
+			return
+		case err := <-reply:
+			if err != nil {
+				log.Printf("Keepalive to %s failed because %s", id, err)
+				markLost(fmt.Errorf("keepalive failed: %w", err))
+				return
+			}
+			missed = 0
+		case <-time.After(interval):
+			missed++
+			log.Printf("Keepalive to %s missed %d times", id, missed)
+			if missed >= maxMissed {
+				markLost(fmt.Errorf("%d keepalives were not answered", missed))
+				return
+			}
+		}
+	}
+}
+
+// subsystems lists the clients that have been opened on this connection
+func (conn *SshConnection) subsystems() []string {
+	subsystems := make([]string, 0)
+	if conn.sftpClient != nil {
+		subsystems = append(subsystems, "sftp")
+	}
+	if conn.dockerClient != nil {
+		subsystems = append(subsystems, "docker")
+	}
+
+	conn.dockerStateMu.Lock()
+	if conn.dockerState != nil && !conn.dockerState.failed() {
+		subsystems = append(subsystems, "docker_state")
+	}
+	conn.dockerStateMu.Unlock()
+
+	if conn.systemdInit.initialized() {
+		subsystems = append(subsystems, "systemd")
+	}
+	if conn.systemdEventsInit.initialized() {
+		subsystems = append(subsystems, "systemd_events")
+	}
+	if conn.currentOverflow() != nil {
+		subsystems = append(subsystems, "overflow")
+	}
+
+	return subsystems
 }
 
 func (conn *SshConnection) Close() error {
+	conn.markLost(errors.New("connection closed"))
+
+	conn.dockerStateMu.Lock()
+	if conn.dockerState != nil {
+		conn.dockerState.Close()
+	}
+	conn.dockerStateMu.Unlock()
+
+	// Waits for a systemd connection that is being opened so that it is not leaked
+	conn.systemdInit.mu.Lock()
 	if conn.systemdHandle != nil {
 		conn.systemdHandle.Close()
 	}
+	conn.systemdInit.mu.Unlock()
 
-	if err := conn.sftpClient.Close(); err != nil {
-		return err
+	if conn.dockerClient != nil {
+		conn.dockerClient.Close()
 	}
 
-	if err := conn.client.Close(); err != nil {
-		return err
+	conn.overflowInit.mu.Lock()
+	if conn.overflow != nil {
+		conn.overflow.Close()
 	}
+	conn.overflowInit.mu.Unlock()
 
-	return nil
+	// The SSH client is closed even when sftp fails to close so that the underlying connection is not leaked
+	var sftpErr error
+	if conn.sftpClient != nil {
+		sftpErr = conn.sftpClient.Close()
+	}
+
+	clientErr := conn.client.Close()
+
+	if conn.jumpHandle != nil {
+		conn.jumpHandle.Close()
+	}
+
+	if clientErr != nil {
+		return clientErr
+	}
+
+	return sftpErr
+}
+
+// connectionProblem describes why GetConnection failed, host key errors get their own problem types
+func connectionProblem(err error) iris.Problem {
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		return iris.NewProblem().
+			Title(authErr.Title).
+			Status(iris.StatusBadRequest).
+			Type(authErr.Type).
+			DetailErr(err)
+	}
+
+	var hostKeyErr *HostKeyError
+	if errors.As(err, &hostKeyErr) {
+		if hostKeyErr.Mismatch {
+			return iris.NewProblem().
+				Title("Host key mismatch").
+				Status(iris.StatusBadRequest).
+				Type("host_key_mismatch").
+				DetailErr(err)
+		}
+
+		return iris.NewProblem().
+			Title("Host key not trusted").
+			Status(iris.StatusBadRequest).
+			Type("host_key_unknown").
+			DetailErr(err)
+	}
+
+	return iris.NewProblem().
+		Title("Connection to target host failed").
+		Status(iris.StatusBadRequest).
+		Type("connection_err").
+		DetailErr(err)
 }
 
 var sshTracer = otel.Tracer("SSH")
 var backgroundTracker = otel.Tracer("Proxy background")
 
-func ConnectToHost(ctx context.Context, args *SshConnectionCredentials) (*SshConnection, error) {
+// dialHost opens an authenticated SSH client to args.Host, tunnelling through pooled bastion connections when
+// jump hosts are configured. The returned handle holds the bastion and must be closed together with the client.
+func dialHost(ctx context.Context, args *SshConnectionCredentials) (*ssh.Client, *ConnectionHandle, error) {
 	id := fmt.Sprintf("%s@%s", args.Username, args.Host)
 
-	childCtx, span := sshTracer.Start(ctx, fmt.Sprintf("Connect to %s", id))
+	childCtx, span := sshTracer.Start(ctx, fmt.Sprintf("Dial %s", id))
 	defer span.End()
 
-	var authMethod []ssh.AuthMethod
-
-	if len(args.Pkey) > 0 {
-		span.AddEvent("Parsing private key")
-		// Create the Signer for this private key.
-		signer, err := ssh.ParsePrivateKey([]byte(args.Pkey))
-		if err != nil {
-			log.Printf("Unable to parse private key: %v", err)
-			return nil, err
-		}
-
-		authMethod = append(authMethod, ssh.PublicKeys(signer))
+	span.AddEvent("Creating auth methods")
+	authMethod, _, err := createAuth(args)
+	if err != nil {
+		log.Printf("Unable to use credentials for %s: %v", id, err)
+		span.RecordError(err)
+		return nil, nil, err
 	}
 
-	if len(args.Password) > 0 {
-		authMethod = append(authMethod, ssh.Password(args.Password))
+	var hostKeyErr error
+	hostKeyCallback, err := createHostKeyCallback(args, &hostKeyErr)
+	if err != nil {
+		span.RecordError(err)
+		return nil, nil, err
 	}
 
 	sshConfig := &ssh.ClientConfig{
 		Timeout:         30 * time.Second,
 		User:            args.Username,
 		Auth:            authMethod,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: hostKeyCallback,
 	}
 
-	span.AddEvent("Dialing")
-	log.Printf("Connecting to: %s\n", id)
-	sshClient, err := ssh.Dial("tcp", args.Host, sshConfig)
+	jump := args.jumpHost()
+	if jump == nil {
+		span.AddEvent("Dialing")
+		log.Printf("Connecting to: %s\n", id)
+		sshClient, err := ssh.Dial("tcp", args.Host, sshConfig)
+		if err != nil {
+			log.Printf("Connection to %s failed with %s\n", id, err)
+			span.RecordError(err)
+			return nil, nil, wrapHandshakeError(err, hostKeyErr)
+		}
+
+		return sshClient, nil, nil
+	}
+
+	span.AddEvent("Acquiring jump host")
+	jumpHandle, err := GetBastionConnection(childCtx, jump)
+	if err != nil {
+		log.Printf("Connection to jump host %s@%s failed with %s\n", jump.Username, jump.Host, err)
+		span.RecordError(err)
+		return nil, nil, fmt.Errorf("jump host %s@%s: %w", jump.Username, jump.Host, err)
+	}
+
+	span.AddEvent("Dialing through jump host")
+	log.Printf("Connecting to: %s through %s\n", id, jumpHandle.conn.id)
+	tunnel, err := jumpHandle.conn.client.Dial("tcp", args.Host)
 	if err != nil {
 		log.Printf("Connection to %s failed with %s\n", id, err)
+		span.RecordError(err)
+		jumpHandle.Close()
+		return nil, nil, err
+	}
+
+	clientConn, chans, reqs, err := ssh.NewClientConn(tunnel, args.Host, sshConfig)
+	if err != nil {
+		log.Printf("Connection to %s failed with %s\n", id, err)
+		span.RecordError(err)
+		tunnel.Close()
+		jumpHandle.Close()
+		return nil, nil, wrapHandshakeError(err, hostKeyErr)
+	}
+
+	return ssh.NewClient(clientConn, chans, reqs), jumpHandle, nil
+}
+
+// forwardAgent serves the key from the credentials to agent forwarding requests of sessions on sshClient
+func forwardAgent(sshClient *ssh.Client, args *SshConnectionCredentials) error {
+	_, keyring, err := createAuth(args)
+	if err != nil {
+		return err
+	}
+
+	if keyring == nil {
+		return &AuthError{Type: "agent_forwarding_err", Title: "Agent forwarding requires a private key", Err: fmt.Errorf("no private key given")}
+	}
+
+	if err := agent.ForwardToAgent(sshClient, keyring); err != nil {
+		return &AuthError{Type: "agent_forwarding_err", Title: "Agent forwarding failed", Err: err}
+	}
+
+	return nil
+}
+
+// ConnectToBastion opens a bare connection that is only used to tunnel to other hosts, so it does not
+// require shell, sftp or docker on the bastion
+func ConnectToBastion(ctx context.Context, args *SshConnectionCredentials) (*SshConnection, error) {
+	sshClient, jumpHandle, err := dialHost(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SshConnection{
+		id:         fmt.Sprintf("%s@%s", args.Username, args.Host),
+		host:       args.Host,
+		client:     sshClient,
+		ctx:        context.Background(),
+		jumpHandle: jumpHandle,
+		lost:       make(chan struct{}),
+	}, nil
+}
+
+func ConnectToHost(ctx context.Context, args *SshConnectionCredentials) (*SshConnection, error) {
+	id := fmt.Sprintf("%s@%s", args.Username, args.Host)
+
+	childCtx, span := sshTracer.Start(ctx, fmt.Sprintf("Connect to %s", id))
+	defer span.End()
+
+	sshClient, jumpHandle, err := dialHost(childCtx, args)
+	if err != nil {
 		span.RecordError(err)
 		return nil, err
 	}
 
+	// Tear down the client and release the jump host if any of the subsystems fails to initialize
+	initialized := false
+	defer func() {
+		if !initialized {
+			sshClient.Close()
+			if jumpHandle != nil {
+				jumpHandle.Close()
+			}
+		}
+	}()
+
+	if args.ForwardAgent {
+		span.AddEvent("Forwarding agent")
+		if err := forwardAgent(sshClient, args); err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+	}
+
 	span.AddEvent("Creating session")
 	session, err := sshClient.NewSession()
 	if err != nil {
@@ -120,8 +505,15 @@ func ConnectToHost(ctx context.Context, args *SshConnectionCredentials) (*SshCon
 
 	conn := SshConnection{
 		id:           id,
+		host:         args.Host,
 		client:       sshClient,
 		shellSession: session,
+		jumpHandle:   jumpHandle,
+		forwardAgent: args.ForwardAgent,
+		sessions:     newSessionClient(sshClient, nil),
+		streams:      newStreamSlots(),
+		dial:         dialSessionClient(args),
+		lost:         make(chan struct{}),
 	}
 
 	log.Printf("Connection to %s successful\n", id)
@@ -156,5 +548,10 @@ func ConnectToHost(ctx context.Context, args *SshConnectionCredentials) (*SshCon
 		return nil, err
 	}
 
+	initialized = true
+
+	span.AddEvent("Starting docker state")
+	conn.startDockerState()
+
 	return &conn, nil
 }
@@ -9,7 +9,11 @@ import (
 	"github.com/kataras/iris/v12/middleware/jwt"
 	"go.opentelemetry.io/otel"
 	"log"
+	"path"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type SystemdHandle struct {
@@ -20,7 +24,7 @@ type SystemdHandle struct {
 var systemdTracer = otel.Tracer("Systemd")
 
 func (conn *SshConnection) GetSystemdConnection(ctx context.Context) (*SystemdHandle, error) {
-	if conn.systemdHandle == nil {
+	err := conn.systemdInit.Do(func() error {
 		log.Printf("Connecting to systemd")
 		_, span := sshTracer.Start(ctx, "Connecting to systemd")
 		defer span.End()
@@ -34,19 +38,18 @@ func (conn *SshConnection) GetSystemdConnection(ctx context.Context) (*SystemdHa
 
 			dbusConn, err := dbus.NewConn(socketConn)
 			if err != nil {
+				socketConn.Close()
 				span.RecordError(err)
 				return nil, err
 			}
 
 			methods := []dbus.Auth{dbus.AuthExternal(strconv.Itoa(conn.uid))}
 
+			// Only the bus is closed, the SSH connection stays usable for everything else
 			err = dbusConn.Auth(methods)
 			if err != nil {
-				if err := conn.Close(); err != nil {
-					span.RecordError(err)
-					return nil, err
-				}
-
+				dbusConn.Close()
+				span.RecordError(err)
 				return nil, err
 			}
 
@@ -54,10 +57,14 @@ func (conn *SshConnection) GetSystemdConnection(ctx context.Context) (*SystemdHa
 		})
 		if err != nil {
 			span.RecordError(err)
-			return nil, err
+			return err
 		}
 
 		conn.systemdHandle = connection
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return &SystemdHandle{
@@ -79,7 +86,7 @@ type SystemdService struct {
 	IsRunning   bool   `json:"isRunning"`
 	IsFailed    bool   `json:"isFailed"`
 	IsLoading   bool   `json:"isLoading"`
-	LoadState   string `json:"loadState"`   // loaded, error, masked
+	LoadState   string `json:"loadState"`   // loaded, not-found, error, masked, empty for unit files that are not loaded
 	ActiveState string `json:"activeState"` // active, reloading, inactive, failed, activating, deactivating. active
 	SubState    string `json:"subState"`
 }
@@ -107,23 +114,206 @@ func (handle *SystemdHandle) SystemdGetService(name string) (*SystemdService, er
 	}, nil
 }
 
+// SystemdServiceFilter narrows down SystemdListServices, empty fields match everything
+type SystemdServiceFilter struct {
+	Patterns     []string // glob patterns on the unit name
+	Types        []string // service, timer, socket...
+	ActiveStates []string
+	Enabled      *bool
+}
+
+func (filter *SystemdServiceFilter) matches(service *SystemdService) bool {
+	if len(filter.Types) > 0 {
+		matched := false
+		for _, unitType := range filter.Types {
+			if strings.HasSuffix(service.Id, "."+unitType) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	if len(filter.ActiveStates) > 0 {
+		matched := false
+		for _, state := range filter.ActiveStates {
+			if service.ActiveState == state {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	return filter.Enabled == nil || *filter.Enabled == service.IsEnabled
+}
+
+// SystemdListServices lists loaded units together with installed unit files that are not loaded yet, so that
+// disabled and inactive units show up as well
+func (handle *SystemdHandle) SystemdListServices(filter *SystemdServiceFilter) ([]SystemdService, error) {
+	log.Printf("Listing systemd services %v", filter.Patterns)
+
+	patterns := filter.Patterns
+	if len(patterns) == 0 {
+		patterns = []string{"*"}
+	}
+
+	units, err := handle.systemdConn.ListUnitsByPatterns(nil, patterns)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing systemd units because: %w", err)
+	}
+
+	unitFiles, err := handle.systemdConn.ListUnitFilesByPatterns(nil, patterns)
+	if err != nil {
+		return nil, fmt.Errorf("failed listing systemd unit files because: %w", err)
+	}
+
+	files := make(map[string]systemdDbus.UnitFile, len(unitFiles))
+	for _, unitFile := range unitFiles {
+		files[path.Base(unitFile.Path)] = unitFile
+	}
+
+	services := make([]SystemdService, 0, len(units))
+	for _, unit := range units {
+		file := files[unit.Name]
+		delete(files, unit.Name)
+
+		services = append(services, SystemdService{
+			Id:          unit.Name,
+			Description: unit.Description,
+			IsEnabled:   file.Type == "enabled",
+			Path:        file.Path,
+			IsActive:    unit.ActiveState == "active",
+			IsRunning:   unit.SubState == "running",
+			IsFailed:    unit.ActiveState == "failed",
+			IsLoading:   unit.ActiveState == "reloading" || unit.ActiveState == "deactivating" || unit.ActiveState == "activating",
+			SubState:    unit.SubState,
+			ActiveState: unit.ActiveState,
+			LoadState:   unit.LoadState,
+		})
+	}
+
+	// Unit files that are not loaded have no load state, except masked ones which systemd can tell without loading them
+	for name, file := range files {
+		loadState := ""
+		if file.Type == "masked" {
+			loadState = "masked"
+		}
+
+		services = append(services, SystemdService{
+			Id:          name,
+			IsEnabled:   file.Type == "enabled",
+			Path:        file.Path,
+			SubState:    "dead",
+			ActiveState: "inactive",
+			LoadState:   loadState,
+		})
+	}
+
+	matching := make([]SystemdService, 0, len(services))
+	for i := range services {
+		if filter.matches(&services[i]) {
+			matching = append(matching, services[i])
+		}
+	}
+
+	sort.Slice(matching, func(i, j int) bool {
+		return matching[i].Id < matching[j].Id
+	})
+
+	return matching, nil
+}
+
+// defaultSystemdJobTimeout is how long start, stop and restart wait for the job when wait is set without a timeout
+const defaultSystemdJobTimeout = 90 * time.Second
+
+type SystemdJobResponse struct {
+	// Result is done, canceled, timeout, failed, dependency or skipped as reported by systemd, or timeout when the
+	// job did not finish in time
+	Result  string          `json:"result"`
+	Service *SystemdService `json:"service"`
+}
+
+// readSystemdJobWait reads the wait and timeout parameters of the job routes, timeout is in seconds
+func readSystemdJobWait(ctx iris.Context) (bool, time.Duration, bool) {
+	wait, _ := ctx.URLParamBool("wait")
+	timeout := defaultSystemdJobTimeout
+
+	if param := ctx.URLParam("timeout"); param != "" {
+		seconds, err := strconv.Atoi(param)
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > maxCommandTimeout {
+			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+				Title("Invalid timeout").
+				Type("invalid_timeout").
+				Detail(fmt.Sprintf("timeout must be a number of seconds between 1 and %d", int(maxCommandTimeout.Seconds()))))
+			return false, 0, false
+		}
+
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	return wait, timeout, true
+}
+
+// runJob queues a job for unit through queue. Without wait it returns as soon as the job is queued, otherwise it
+// waits up to timeout for the job result and returns it with the resulting state of the unit.
+func (handle *SystemdHandle) runJob(ctx context.Context, unit string, wait bool, timeout time.Duration, queue func(result chan<- string) (int, error)) (*SystemdJobResponse, error) {
+	var result chan string
+	if wait {
+		result = make(chan string, 1)
+	}
+
+	if _, err := queue(result); err != nil {
+		return nil, err
+	}
+
+	if !wait {
+		return nil, nil
+	}
+
+	response := SystemdJobResponse{}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case response.Result = <-result:
+	case <-timer.C:
+		response.Result = "timeout"
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	log.Printf("Job for %s finished with %s", unit, response.Result)
+
+	service, err := handle.SystemdGetService(unit)
+	if err != nil {
+		return nil, err
+	}
+
+	response.Service = service
+	return &response, nil
+}
+
 func acquireSystemd(ctx iris.Context) (*ConnectionHandle, *SystemdHandle, iris.Problem) {
 	handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
 	if err != nil {
-		return nil, nil, iris.NewProblem().
-			Title("Connection to target host failed").
-			Status(iris.StatusBadRequest).
-			Type("connection_err").
-			DetailErr(err)
+		return nil, nil, connectionProblem(err)
 	}
 
 	systemd, err := handle.conn.GetSystemdConnection(ctx.Request().Context())
 	if err != nil {
-		return nil, nil, iris.NewProblem().
+		handle.Close()
+		return nil, nil, handle.problem(iris.NewProblem().
 			Title("Systemd connection error").
 			Status(iris.StatusBadRequest).
 			Type("systemd_connection_err").
-			DetailErr(err)
+			DetailErr(err))
 	}
 
 	return handle, systemd, nil
@@ -140,10 +330,10 @@ func SystemdGetServiceRoute(app *iris.Application) {
 
 		services, err := systemd.SystemdGetService(ctx.URLParam("id"))
 		if err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
 				Title("Systemd services detail error").
 				Type("systemd_get_service").
-				DetailErr(err))
+				DetailErr(err)))
 			return
 		}
 
@@ -151,8 +341,53 @@ func SystemdGetServiceRoute(app *iris.Application) {
 	}).SetName("Systemd service detail")
 }
 
+func SystemdListServicesRoute(app *iris.Application) {
+	app.Get("/systemd/services", func(ctx iris.Context) {
+		filter := SystemdServiceFilter{
+			Patterns:     ctx.URLParamSlice("pattern"),
+			Types:        ctx.URLParamSlice("type"),
+			ActiveStates: ctx.URLParamSlice("active_state"),
+		}
+
+		if ctx.URLParamExists("enabled") {
+			enabled, err := ctx.URLParamBool("enabled")
+			if err != nil {
+				ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+					Title("Invalid enabled filter").
+					Type("invalid_filter").
+					DetailErr(err))
+				return
+			}
+			filter.Enabled = &enabled
+		}
+
+		handle, systemd, problem := acquireSystemd(ctx)
+		if problem != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, problem)
+			return
+		}
+		defer handle.Close()
+
+		services, err := systemd.SystemdListServices(&filter)
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Listing systemd services failed").
+				Type("systemd_list_services").
+				DetailErr(err)))
+			return
+		}
+
+		ctx.JSON(services)
+	}).SetName("Systemd services")
+}
+
 func SystemdStartServiceRoute(app *iris.Application) {
 	app.Post("/systemd/service/start", func(ctx iris.Context) {
+		wait, timeout, ok := readSystemdJobWait(ctx)
+		if !ok {
+			return
+		}
+
 		handle, systemd, problem := acquireSystemd(ctx)
 		if problem != nil {
 			ctx.StopWithProblem(iris.StatusBadRequest, problem)
@@ -161,12 +396,19 @@ func SystemdStartServiceRoute(app *iris.Application) {
 		defer handle.Close()
 
 		log.Printf("Starting service %s", ctx.URLParam("id"))
-		_, err := systemd.systemdConn.StartUnit(ctx.URLParam("id"), "replace", nil)
+		job, err := systemd.runJob(ctx.Request().Context(), ctx.URLParam("id"), wait, timeout, func(result chan<- string) (int, error) {
+			return systemd.systemdConn.StartUnit(ctx.URLParam("id"), "replace", result)
+		})
 		if err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
 				Title("Starting systemd service failed").
 				Type("systemd_start_service").
-				DetailErr(err))
+				DetailErr(err)))
+			return
+		}
+
+		if job != nil {
+			ctx.JSON(job)
 			return
 		}
 
@@ -176,6 +418,11 @@ func SystemdStartServiceRoute(app *iris.Application) {
 
 func SystemdStopServiceRoute(app *iris.Application) {
 	app.Post("/systemd/service/stop", func(ctx iris.Context) {
+		wait, timeout, ok := readSystemdJobWait(ctx)
+		if !ok {
+			return
+		}
+
 		handle, systemd, problem := acquireSystemd(ctx)
 		if problem != nil {
 			ctx.StopWithProblem(iris.StatusBadRequest, problem)
@@ -184,12 +431,19 @@ func SystemdStopServiceRoute(app *iris.Application) {
 		defer handle.Close()
 
 		log.Printf("Stopping service %s", ctx.URLParam("id"))
-		_, err := systemd.systemdConn.StopUnit(ctx.URLParam("id"), "replace", nil)
+		job, err := systemd.runJob(ctx.Request().Context(), ctx.URLParam("id"), wait, timeout, func(result chan<- string) (int, error) {
+			return systemd.systemdConn.StopUnit(ctx.URLParam("id"), "replace", result)
+		})
 		if err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
 				Title("Starting systemd service failed").
 				Type("systemd_start_service").
-				DetailErr(err))
+				DetailErr(err)))
+			return
+		}
+
+		if job != nil {
+			ctx.JSON(job)
 			return
 		}
 
@@ -199,6 +453,11 @@ func SystemdStopServiceRoute(app *iris.Application) {
 
 func SystemdRestartServiceRoute(app *iris.Application) {
 	app.Post("/systemd/service/restart", func(ctx iris.Context) {
+		wait, timeout, ok := readSystemdJobWait(ctx)
+		if !ok {
+			return
+		}
+
 		handle, systemd, problem := acquireSystemd(ctx)
 		if problem != nil {
 			ctx.StopWithProblem(iris.StatusBadRequest, problem)
@@ -207,12 +466,19 @@ func SystemdRestartServiceRoute(app *iris.Application) {
 		defer handle.Close()
 
 		log.Printf("Restarting service %s", ctx.URLParam("id"))
-		_, err := systemd.systemdConn.ReloadOrRestartUnit(ctx.URLParam("id"), "replace", nil)
+		job, err := systemd.runJob(ctx.Request().Context(), ctx.URLParam("id"), wait, timeout, func(result chan<- string) (int, error) {
+			return systemd.systemdConn.ReloadOrRestartUnit(ctx.URLParam("id"), "replace", result)
+		})
 		if err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
 				Title("Restarting systemd service failed").
 				Type("systemd_restart_service").
-				DetailErr(err))
+				DetailErr(err)))
+			return
+		}
+
+		if job != nil {
+			ctx.JSON(job)
 			return
 		}
 
@@ -234,10 +500,10 @@ func SystemdEnableServiceRoute(app *iris.Application) {
 		units[0] = ctx.URLParam("id")
 		_, _, err := systemd.systemdConn.EnableUnitFiles(units, false, false)
 		if err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
 				Title("Enabling systemd service failed").
 				Type("systemd_enable_service").
-				DetailErr(err))
+				DetailErr(err)))
 			return
 		}
 
@@ -259,10 +525,10 @@ func SystemdDisableServiceRoute(app *iris.Application) {
 		units[0] = ctx.URLParam("id")
 		_, err := systemd.systemdConn.DisableUnitFiles(units, false)
 		if err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
 				Title("Disabling systemd service failed").
 				Type("systemd_disable_service").
-				DetailErr(err))
+				DetailErr(err)))
 			return
 		}
 
@@ -270,6 +536,19 @@ func SystemdDisableServiceRoute(app *iris.Application) {
 	}).SetName("Systemd service disable")
 }
 
+// daemonReload reloads unit files, through a command because that is four times faster than over dbus for me
+// for whatever reason
+func (conn *SshConnection) daemonReload(ctx context.Context) error {
+	res, err := conn.RunCommand(ctx, "systemctl daemon-reload")
+	if err != nil {
+		return err
+	} else if res.Code != 0 || res.Error != "" {
+		return fmt.Errorf("%s%s", res.Error, string(res.Stderr))
+	}
+
+	return nil
+}
+
 func SystemdReloadRoute(app *iris.Application) {
 	app.Post("/systemd/reload", func(ctx iris.Context) {
 		//handle, systemd, problem := acquireSystemd(ctx)
@@ -281,10 +560,7 @@ func SystemdReloadRoute(app *iris.Application) {
 
 		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
 		if err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
-				Title("Connection to target host failed").
-				Type("connection_err").
-				DetailErr(err))
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
 			return
 		}
 		defer handle.Close()
@@ -298,19 +574,11 @@ func SystemdReloadRoute(app *iris.Application) {
 		//	return
 		//}
 
-		// Reloading via command is four times faster for me for whatever reason
-		res, err := handle.conn.RunCommand(ctx.Request().Context(), "systemctl daemon-reload")
-		if err != nil {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
-				Title("Reloading systemd services failed").
-				Type("systemd_reload").
-				DetailErr(err))
-			return
-		} else if res.Code != 0 {
-			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+		if err := handle.conn.daemonReload(ctx.Request().Context()); err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
 				Title("Reloading systemd services failed").
 				Type("systemd_reload").
-				DetailErr(fmt.Errorf("%s", string(res.Stderr))))
+				DetailErr(err)))
 			return
 		}
 
@@ -318,85 +586,182 @@ func SystemdReloadRoute(app *iris.Application) {
 	}).SetName("Systemd reload")
 }
 
-//func UpdateSystemdServiceRoute(app *iris.Application) {
-//  type UpdateSystemdServiceRequest struct {
-//    Contents     []byte `json:"contents" validate:"required"`
-//    Path         string `json:"path" validate:"required"`
-//    IsActive  bool   `json:"is_active" validate:"required"`
-//    IsEnabled  bool   `json:"is_enabled" validate:"required"`
-//  }
-//
-//	app.Post("/systemd/service", func(ctx iris.Context) {
-//    var body UpdateSystemdServiceRequest
-//    if err := ctx.ReadBody(&body); err != nil {
-//      ctx.StopWithError(iris.StatusBadRequest, err)
-//      return
-//    }
-//
-//		handle, systemd, problem := acquireSystemd(ctx)
-//		if problem != nil {
-//			ctx.StopWithProblem(iris.StatusBadRequest, problem)
-//			return
-//		}
-//		defer handle.Close()
-//		defer systemd.Close()
-//
-//    serviceStatus, err := systemd.SystemdGetService(body.Path)
-//    if err != nil {
-//      ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
-//        Title("Systemd services detail error").
-//        Type("systemd_get_service").
-//        DetailErr(err))
-//      return
-//    }
-//
-//    modified, err := handle.conn.upsertFile(body.Path, 1_000_000, false, body.Contents)
-//    if err != nil {
-//      ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
-//        Title("Failed to update systemd file").
-//        Type("file_update").
-//        DetailErr(err))
-//    }
-//
-//    if serviceStatus == nil || serviceStatus.IsEnabled != body.IsEnabled {
-//      units := make([]string, 1)
-//      units[0] = ctx.URLParam(body.Path)
-//
-//      if body.IsEnabled {
-//        if _, _, err := systemd.systemdConn.EnableUnitFiles(units, false, true); err != nil {
-//          ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
-//            Title("Enabling systemd service failed").
-//            Type("systemd_enable_service").
-//            DetailErr(err))
-//          return
-//        }
-//      } else {
-//        if _, err := systemd.systemdConn.DisableUnitFiles(units, false); err != nil {
-//          ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
-//            Title("Disabling systemd service failed").
-//            Type("systemd_disable_service").
-//            DetailErr(err))
-//          return
-//        }
-//      }
-//    }
-//
-//    if modified || serviceStatus == nil || serviceStatus.IsEnabled != body.IsEnabled {
-//      if err := systemd.systemdConn.Reload(); err != nil {
-//        ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
-//          Title("Reloading systemd services failed").
-//          Type("systemd_reload").
-//          DetailErr(err))
-//        return
-//      }
-//    }
-//
-//    if serviceStatus == nil || serviceStatus.IsActive != body.IsActive {
-//      if body.IsActive {
-//
-//      }
-//    }
-//
-//		ctx.StatusCode(iris.StatusOK)
-//	})
-//}
+type SystemdReconcileRequest struct {
+	FileMetadata
+	Id string `json:"id" validate:"required"`
+	// Path of the unit file, defaults to /etc/systemd/system/<id>
+	Path string `json:"path"`
+	// Contents of the unit file, the file is left alone when it is not given
+	Contents []byte `json:"contents"`
+	// Enabled and Active are the desired states, unset leaves the state as it is
+	Enabled *bool `json:"enabled"`
+	Active  *bool `json:"active"`
+}
+
+type SystemdReconcileAction struct {
+	Action string `json:"action"` // write_unit_file, enable, disable, daemon_reload, start, stop, restart
+	Detail string `json:"detail"`
+}
+
+type SystemdReconcileResponse struct {
+	DryRun  bool                     `json:"dryRun"`
+	Actions []SystemdReconcileAction `json:"actions"`
+	// Service is the state after reconciling, or the current state on a dry run
+	Service *SystemdService `json:"service"`
+}
+
+// SystemdReconcile brings a unit to the desired state and returns the actions it took. Only the actions that are
+// needed are taken, so running it again with the same request does nothing. On a dry run the actions are only planned.
+func (handle *SystemdHandle) SystemdReconcile(ctx context.Context, request *SystemdReconcileRequest, dryRun bool) (*SystemdReconcileResponse, error) {
+	conn := handle.sshConn
+	response := SystemdReconcileResponse{
+		DryRun:  dryRun,
+		Actions: make([]SystemdReconcileAction, 0),
+	}
+
+	act := func(action string, detail string, apply func() error) error {
+		response.Actions = append(response.Actions, SystemdReconcileAction{Action: action, Detail: detail})
+		if dryRun {
+			return nil
+		}
+
+		log.Printf("Reconciling %s: %s %s", request.Id, action, detail)
+		if err := apply(); err != nil {
+			return fmt.Errorf("%s failed: %w", action, err)
+		}
+
+		return nil
+	}
+
+	service, err := handle.SystemdGetService(request.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	unitPath := request.Path
+	if unitPath == "" {
+		unitPath = path.Join("/etc/systemd/system", request.Id)
+	}
+
+	changed := false
+	modified := false
+	if request.Contents != nil {
+		attrs, err := conn.resolveFileMetadata(&request.FileMetadata)
+		if err != nil {
+			return nil, err
+		}
+
+		modified, err = conn.fileDiffers(ctx, unitPath, request.Contents, attrs)
+		if err != nil {
+			return nil, err
+		}
+
+		if modified {
+			changed = true
+			err := act("write_unit_file", unitPath, func() error {
+				if err := conn.ensureDirectoryExists(ctx, path.Dir(unitPath)); err != nil {
+					return err
+				}
+
+				return conn.writeFile(ctx, unitPath, request.Contents, attrs)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// A unit that is written for the first time is enabled by its file path because systemd does not know it yet
+	enableTarget := request.Id
+	if service.LoadState == "not-found" {
+		enableTarget = unitPath
+	}
+
+	if request.Enabled != nil && *request.Enabled != service.IsEnabled {
+		changed = true
+		if *request.Enabled {
+			err = act("enable", enableTarget, func() error {
+				_, _, err := handle.systemdConn.EnableUnitFiles([]string{enableTarget}, false, true)
+				return err
+			})
+		} else {
+			err = act("disable", request.Id, func() error {
+				_, err := handle.systemdConn.DisableUnitFiles([]string{request.Id}, false)
+				return err
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if changed {
+		if err := act("daemon_reload", "", func() error { return conn.daemonReload(ctx) }); err != nil {
+			return nil, err
+		}
+	}
+
+	if request.Active != nil {
+		switch {
+		case *request.Active && !service.IsActive:
+			err = act("start", request.Id, func() error {
+				_, err := handle.systemdConn.StartUnit(request.Id, "replace", nil)
+				return err
+			})
+		case *request.Active && modified:
+			// The running unit still uses the old unit file, a reload would keep its old ExecStart and Environment
+			err = act("restart", request.Id, func() error {
+				_, err := handle.systemdConn.RestartUnit(request.Id, "replace", nil)
+				return err
+			})
+		case !*request.Active && service.IsActive:
+			err = act("stop", request.Id, func() error {
+				_, err := handle.systemdConn.StopUnit(request.Id, "replace", nil)
+				return err
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !dryRun && len(response.Actions) > 0 {
+		service, err = handle.SystemdGetService(request.Id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	response.Service = service
+	return &response, nil
+}
+
+func SystemdReconcileServiceRoute(app *iris.Application) {
+	app.Post("/systemd/service", func(ctx iris.Context) {
+		var body SystemdReconcileRequest
+		if err := ctx.ReadBody(&body); err != nil {
+			ctx.StopWithError(iris.StatusBadRequest, err)
+			return
+		}
+
+		dryRun, _ := ctx.URLParamBool("dry_run")
+
+		handle, systemd, problem := acquireSystemd(ctx)
+		if problem != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, problem)
+			return
+		}
+		defer handle.Close()
+
+		response, err := systemd.SystemdReconcile(ctx.Request().Context(), &body, dryRun)
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Reconciling systemd service failed").
+				Type("systemd_reconcile").
+				DetailErr(err)))
+			return
+		}
+
+		ctx.JSON(response)
+	}).SetName("Systemd service reconcile")
+}
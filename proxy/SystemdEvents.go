@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	systemdDbus "github.com/coreos/go-systemd/dbus"
+	"github.com/kataras/iris/v12"
+	"log"
+	"path"
+	"sync"
+)
+
+// SystemdEvents fans unit state changes of a host out to subscribers. The dbus connection only takes one
+// substate subscriber, so it is shared by every event stream on the connection.
+type SystemdEvents struct {
+	systemd     *SystemdHandle
+	mu          sync.Mutex
+	subscribers map[*SystemdEventSubscriber]struct{}
+}
+
+// SystemdEventSubscriber receives the state of units that match Units or Patterns whenever it changes.
+// Updates is closed when the subscriber falls behind or the connection is lost.
+type SystemdEventSubscriber struct {
+	Units    []string
+	Patterns []string
+	Updates  chan SystemdService
+}
+
+func (subscriber *SystemdEventSubscriber) matches(unit string) bool {
+	for _, name := range subscriber.Units {
+		if name == unit {
+			return true
+		}
+	}
+
+	for _, pattern := range subscriber.Patterns {
+		if matched, _ := path.Match(pattern, unit); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetSystemdEvents returns the unit state change feed of this connection, subscribing to systemd on first use
+func (conn *SshConnection) GetSystemdEvents(ctx context.Context) (*SystemdEvents, error) {
+	systemd, err := conn.GetSystemdConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.systemdEventsInit.Do(func() error {
+		log.Printf("Subscribing to systemd events on %s", conn.id)
+		if err := systemd.systemdConn.Subscribe(); err != nil {
+			return err
+		}
+
+		events := &SystemdEvents{
+			systemd:     systemd,
+			subscribers: make(map[*SystemdEventSubscriber]struct{}),
+		}
+
+		updates := make(chan *systemdDbus.SubStateUpdate, subscriberBuffer)
+		errs := make(chan error, subscriberBuffer)
+		systemd.systemdConn.SetSubStateSubscriber(updates, errs)
+
+		conn.systemdEvents = events
+		go events.run(conn.lost, updates, errs)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.systemdEvents, nil
+}
+
+func (events *SystemdEvents) run(lost chan struct{}, updates chan *systemdDbus.SubStateUpdate, errs chan error) {
+	for {
+		select {
+		case update := <-updates:
+			events.publish(update.UnitName)
+		case err := <-errs:
+			log.Printf("Missed systemd event on %s because %s", events.systemd.sshConn.id, err)
+		case <-lost:
+			events.mu.Lock()
+			for subscriber := range events.subscribers {
+				delete(events.subscribers, subscriber)
+				close(subscriber.Updates)
+			}
+			events.mu.Unlock()
+			return
+		}
+	}
+}
+
+// publish reads the state of unit once and sends it to every subscriber that is interested in it
+func (events *SystemdEvents) publish(unit string) {
+	events.mu.Lock()
+	interested := false
+	for subscriber := range events.subscribers {
+		if subscriber.matches(unit) {
+			interested = true
+			break
+		}
+	}
+	events.mu.Unlock()
+
+	if !interested {
+		return
+	}
+
+	service, err := events.systemd.SystemdGetService(unit)
+	if err != nil {
+		log.Printf("Failed to read state of %s because %s", unit, err)
+		return
+	}
+
+	events.mu.Lock()
+	defer events.mu.Unlock()
+
+	for subscriber := range events.subscribers {
+		if !subscriber.matches(unit) {
+			continue
+		}
+
+		select {
+		case subscriber.Updates <- *service:
+		default:
+			log.Printf("Disconnecting slow systemd event subscriber on %s", events.systemd.sshConn.id)
+			delete(events.subscribers, subscriber)
+			close(subscriber.Updates)
+		}
+	}
+}
+
+// Subscribe registers a subscriber and returns the current state of the units it is interested in
+func (events *SystemdEvents) Subscribe(units []string, patterns []string) ([]SystemdService, *SystemdEventSubscriber, error) {
+	subscriber := &SystemdEventSubscriber{
+		Units:    units,
+		Patterns: patterns,
+		Updates:  make(chan SystemdService, subscriberBuffer),
+	}
+
+	// Subscribing before reading the state means a change in between is sent twice rather than lost
+	events.mu.Lock()
+	events.subscribers[subscriber] = struct{}{}
+	events.mu.Unlock()
+
+	snapshot := make([]SystemdService, 0)
+	if len(patterns) > 0 {
+		services, err := events.systemd.SystemdListServices(&SystemdServiceFilter{Patterns: patterns})
+		if err != nil {
+			events.Unsubscribe(subscriber)
+			return nil, nil, err
+		}
+		snapshot = append(snapshot, services...)
+	}
+
+	for _, unit := range units {
+		service, err := events.systemd.SystemdGetService(unit)
+		if err != nil {
+			events.Unsubscribe(subscriber)
+			return nil, nil, err
+		}
+		snapshot = append(snapshot, *service)
+	}
+
+	return snapshot, subscriber, nil
+}
+
+func (events *SystemdEvents) Unsubscribe(subscriber *SystemdEventSubscriber) {
+	events.mu.Lock()
+	defer events.mu.Unlock()
+
+	if _, ok := events.subscribers[subscriber]; ok {
+		delete(events.subscribers, subscriber)
+		close(subscriber.Updates)
+	}
+}
+
+func SystemdEventsRoute(app *iris.Application) {
+	app.Get("/systemd/events", func(ctx iris.Context) {
+		units := ctx.URLParamSlice("id")
+		patterns := ctx.URLParamSlice("pattern")
+		if len(units) == 0 && len(patterns) == 0 {
+			ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+				Title("Missing units").
+				Type("systemd_events").
+				Detail("at least one id or pattern is required"))
+			return
+		}
+
+		handle, _, problem := acquireSystemd(ctx)
+		if problem != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, problem)
+			return
+		}
+		defer handle.Close()
+
+		events, err := handle.conn.GetSystemdEvents(ctx.Request().Context())
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Subscribing to systemd events failed").
+				Type("systemd_events").
+				DetailErr(err)))
+			return
+		}
+
+		snapshot, subscriber, err := events.Subscribe(units, patterns)
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Subscribing to systemd events failed").
+				Type("systemd_events").
+				DetailErr(err)))
+			return
+		}
+		defer events.Unsubscribe(subscriber)
+
+		lines := make(chan string)
+		go (func() {
+			defer close(lines)
+
+			// The current state is sent first so that every unit is known before the first change
+			for _, service := range snapshot {
+				lineOut, _ := json.Marshal(service)
+				select {
+				case lines <- string(lineOut):
+				case <-ctx.Request().Context().Done():
+					return
+				}
+			}
+
+			for service := range subscriber.Updates {
+				lineOut, _ := json.Marshal(service)
+				select {
+				case lines <- string(lineOut):
+				case <-ctx.Request().Context().Done():
+					return
+				}
+			}
+		})()
+
+		sse(ctx, lines)
+	}).SetName("Systemd events")
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/middleware/jwt"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TerminalControlMessage is sent by the client as a text message, binary messages are written to stdin as they are
+type TerminalControlMessage struct {
+	Type string `json:"type"` // resize, stdin
+	Cols uint   `json:"cols"`
+	Rows uint   `json:"rows"`
+	Data string `json:"data"`
+}
+
+// TerminalExitMessage is sent as the last text message before the socket is closed
+type TerminalExitMessage struct {
+	Type  string `json:"type"` // exit
+	Code  int    `json:"code"`
+	Error string `json:"error"`
+}
+
+// Origins are not checked because the socket is authorized by the token and CORS allows every origin as well
+var terminalUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// transcript records a terminal session in asciicast v2 format so that it can be replayed with asciinema
+type transcript struct {
+	mu    sync.Mutex
+	file  *os.File
+	start time.Time
+}
+
+func createTranscript(id string, cols int, rows int) (*transcript, error) {
+	dir := viper.GetString("TRANSCRIPT_PATH")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create transcript directory: %w", err)
+	}
+
+	start := time.Now()
+	name := fmt.Sprintf("%s-%s.cast", start.UTC().Format("20060102T150405Z"), strings.NewReplacer("/", "_", ":", "_").Replace(id))
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transcript: %w", err)
+	}
+
+	header, _ := json.Marshal(map[string]interface{}{
+		"version":   2,
+		"width":     cols,
+		"height":    rows,
+		"timestamp": start.Unix(),
+		"title":     id,
+	})
+	if _, err := file.Write(append(header, '\n')); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write transcript: %w", err)
+	}
+
+	log.Printf("Recording shell session on %s to %s", id, file.Name())
+	return &transcript{file: file, start: start}, nil
+}
+
+// record appends an event, kind is o for output, i for input and r for resize
+func (t *transcript) record(kind string, data string) {
+	if t == nil {
+		return
+	}
+
+	event, _ := json.Marshal([]interface{}{time.Since(t.start).Seconds(), kind, data})
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, err := t.file.Write(append(event, '\n')); err != nil {
+		log.Printf("Failed to write transcript %s because %s", t.file.Name(), err)
+	}
+}
+
+func (t *transcript) Close() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.file.Close()
+}
+
+// terminalBridge connects a terminal to a websocket. Output is sent as binary messages, binary messages and stdin
+// control messages from the client are written to input.
+type terminalBridge struct {
+	name   string
+	output io.Reader
+	input  io.Writer
+	resize func(cols uint, rows uint)
+	// close ends the terminal when the client went away, output has to end with it
+	close func()
+	// exit reports how the terminal exited once its output ended
+	exit func() TerminalExitMessage
+	// onOutput and onInput are optional, they see everything that passes through the bridge
+	onOutput func(data []byte)
+	onInput  func(data []byte)
+}
+
+func (bridge *terminalBridge) write(data []byte) error {
+	if bridge.onInput != nil {
+		bridge.onInput(data)
+	}
+
+	_, err := bridge.input.Write(data)
+	return err
+}
+
+// run pumps the terminal until either side is done, the exit message is sent when the terminal ended first
+func (bridge *terminalBridge) run(socket *websocket.Conn) {
+	log.Printf("Opened %s", bridge.name)
+
+	// Output is the only writer to the socket until it is done
+	outputDone := make(chan error, 1)
+	go func() {
+		buffer := make([]byte, 32*1024)
+		for {
+			n, err := bridge.output.Read(buffer)
+			if n > 0 {
+				if bridge.onOutput != nil {
+					bridge.onOutput(buffer[:n])
+				}
+				if err := socket.WriteMessage(websocket.BinaryMessage, buffer[:n]); err != nil {
+					outputDone <- err
+					return
+				}
+			}
+			if err != nil {
+				outputDone <- err
+				return
+			}
+		}
+	}()
+
+	inputDone := make(chan error, 1)
+	go func() {
+		for {
+			messageType, message, err := socket.ReadMessage()
+			if err != nil {
+				inputDone <- err
+				return
+			}
+
+			if messageType == websocket.BinaryMessage {
+				if err := bridge.write(message); err != nil {
+					inputDone <- err
+					return
+				}
+				continue
+			}
+
+			var control TerminalControlMessage
+			if err := json.Unmarshal(message, &control); err != nil {
+				log.Printf("Ignoring invalid terminal control message because %s", err)
+				continue
+			}
+
+			switch control.Type {
+			case "resize":
+				if control.Cols != 0 && control.Rows != 0 {
+					bridge.resize(control.Cols, control.Rows)
+				}
+			case "stdin":
+				if err := bridge.write([]byte(control.Data)); err != nil {
+					inputDone <- err
+					return
+				}
+			}
+		}
+	}()
+
+	select {
+	case <-inputDone:
+		log.Printf("Closing %s because the client disconnected", bridge.name)
+		bridge.close()
+		<-outputDone
+	case <-outputDone:
+		exit := bridge.exit()
+		log.Printf("Closing %s because it exited with %d", bridge.name, exit.Code)
+
+		exitOut, _ := json.Marshal(exit)
+		socket.WriteMessage(websocket.TextMessage, exitOut)
+		socket.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "exited"))
+	}
+}
+
+func shellRoute(app *iris.Application) {
+	app.Get("/shell", func(ctx iris.Context) {
+		handle, err := GetConnection(ctx.Request().Context(), jwt.Get(ctx).(*SshConnectionCredentials))
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, connectionProblem(err))
+			return
+		}
+		defer handle.Close()
+
+		cols := ctx.URLParamIntDefault("cols", 80)
+		rows := ctx.URLParamIntDefault("rows", 24)
+
+		session, err := handle.conn.newStreamSession(ctx.Request().Context())
+		if err != nil {
+			status := iris.StatusBadRequest
+			if errors.Is(err, ErrTooManyStreams) {
+				status = iris.StatusTooManyRequests
+			}
+			ctx.StopWithProblem(status, handle.problem(iris.NewProblem().
+				Title("Opening session failed").
+				Type("shell_err").
+				DetailErr(err)))
+			return
+		}
+		defer session.Close()
+
+		modes := ssh.TerminalModes{
+			ssh.ECHO:          1,
+			ssh.TTY_OP_ISPEED: 14400,
+			ssh.TTY_OP_OSPEED: 14400,
+		}
+		if err := session.RequestPty(ctx.URLParamDefault("term", "xterm-256color"), rows, cols, modes); err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Allocating terminal failed").
+				Type("shell_err").
+				DetailErr(err)))
+			return
+		}
+
+		stdin, err := session.StdinPipe()
+		if err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Opening shell failed").
+				Type("shell_err").
+				DetailErr(err)))
+			return
+		}
+
+		// With a terminal both streams end up on the screen, so they are merged into one
+		output, outputWriter := io.Pipe()
+		session.Stdout = outputWriter
+		session.Stderr = outputWriter
+
+		if err := session.Shell(); err != nil {
+			ctx.StopWithProblem(iris.StatusBadRequest, handle.problem(iris.NewProblem().
+				Title("Opening shell failed").
+				Type("shell_err").
+				DetailErr(err)))
+			return
+		}
+
+		// Input is only recorded when asked for explicitly, it contains everything typed at hidden prompts
+		var record *transcript
+		recordInput, _ := ctx.URLParamBool("transcript_input")
+		if enabled, _ := ctx.URLParamBool("transcript"); enabled {
+			record, err = createTranscript(handle.conn.id, cols, rows)
+			if err != nil {
+				session.Close()
+				ctx.StopWithProblem(iris.StatusBadRequest, iris.NewProblem().
+					Title("Recording transcript failed").
+					Type("transcript_err").
+					DetailErr(err))
+				return
+			}
+			defer record.Close()
+		}
+
+		socket, err := terminalUpgrader.Upgrade(ctx.ResponseWriter(), ctx.Request(), nil)
+		if err != nil {
+			log.Printf("Failed to upgrade shell on %s to websocket because %s", handle.conn.id, err)
+			return
+		}
+		defer socket.Close()
+
+		waitErr := make(chan error, 1)
+		go func() {
+			err := session.Wait()
+			outputWriter.Close()
+			waitErr <- err
+		}()
+
+		bridge := terminalBridge{
+			name:   fmt.Sprintf("shell on %s", handle.conn.id),
+			output: output,
+			input:  stdin,
+			resize: func(cols uint, rows uint) {
+				record.record("r", fmt.Sprintf("%dx%d", cols, rows))
+				if err := session.WindowChange(int(rows), int(cols)); err != nil {
+					log.Printf("Failed to resize shell on %s because %s", handle.conn.id, err)
+				}
+			},
+			close: func() {
+				session.Close()
+				outputWriter.Close()
+			},
+			exit: func() TerminalExitMessage {
+				exit := TerminalExitMessage{Type: "exit"}
+				switch err := (<-waitErr).(type) {
+				case nil:
+				case *ssh.ExitError:
+					exit.Code = err.ExitStatus()
+				default:
+					exit.Error = err.Error()
+				}
+				return exit
+			},
+		}
+
+		if record != nil {
+			bridge.onOutput = func(data []byte) {
+				record.record("o", string(data))
+			}
+			if recordInput {
+				bridge.onInput = func(data []byte) {
+					record.record("i", string(data))
+				}
+			}
+		}
+
+		bridge.run(socket)
+	}).SetName("Shell")
+}
@@ -23,10 +23,39 @@ import (
 	"go.opentelemetry.io/otel/trace"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
+// shuttingDown is closed once the proxy receives a termination signal
+var shuttingDown = make(chan struct{})
+
+// SseEvent is a server sent event, Id is sent as the event id so that clients can resume with Last-Event-ID
+type SseEvent struct {
+	Id   string
+	Data string
+}
+
 func sse(ctx iris.Context, lines chan string) {
+	events := make(chan SseEvent)
+	go func() {
+		defer close(events)
+
+		for line := range lines {
+			select {
+			case events <- SseEvent{Data: line}:
+			case <-ctx.Request().Context().Done():
+				return
+			}
+		}
+	}()
+
+	sseEvents(ctx, events)
+}
+
+func sseEvents(ctx iris.Context, events chan SseEvent) {
 	flusher, ok := ctx.ResponseWriter().Flusher()
 	if !ok {
 		ctx.StopWithText(iris.StatusHTTPVersionNotSupported, "Streaming unsupported!")
@@ -42,7 +71,10 @@ func sse(ctx iris.Context, lines chan string) {
 	ctx.ContentType("text/event-stream")
 	ctx.Header("Cache-Control", "no-cache")
 
-	cancellation := make(chan bool)
+	sseStreams.Inc()
+	defer sseStreams.Dec()
+
+	cancellation := make(chan bool, 1)
 	ctx.OnClose(func(ctx *irisContext.Context) {
 		cancellation <- true
 	})
@@ -52,8 +84,21 @@ func sse(ctx iris.Context, lines chan string) {
 		case <-cancellation:
 			log.Println("Closing request")
 			return
-		case line := <-lines:
-			cw.Write([]byte(fmt.Sprintf("data: %s\n\n", line)))
+		case <-shuttingDown:
+			log.Println("Closing request because of shutdown")
+			cw.Write([]byte("event: shutdown\ndata: shutdown\n\n"))
+			cw.Flush()
+			flusher.Flush()
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+
+			if event.Id != "" {
+				cw.Write([]byte(fmt.Sprintf("id: %s\n", event.Id)))
+			}
+			cw.Write([]byte(fmt.Sprintf("data: %s\n\n", event.Data)))
 			cw.Flush()
 			flusher.Flush()
 		}
@@ -139,24 +184,45 @@ func injectOpenTelemetry(app *iris.Application) {
 }
 
 func main() {
-	go RunConnectionManager()
-
 	viper.SetDefault("JWT_KEY", "vGXyMPbgINeLaAR43zWx1C9R89nVrFqy")
 	//viper.SetDefault("JWE_KEY", "iXbm3fmDPPcgSxLJ4riJCoGN6915oXyg")
 	viper.SetDefault("JAEGER_URL", nil)
+	viper.SetDefault("HOST_KEY_MODE", HostKeyModeTofu)
+	viper.SetDefault("KNOWN_HOSTS_PATH", "known_hosts")
+	viper.SetDefault("SHUTDOWN_TIMEOUT", 30*time.Second)
+	viper.SetDefault("KEEPALIVE_INTERVAL", 15*time.Second)
+	viper.SetDefault("KEEPALIVE_MAX_MISSED", 3)
+	viper.SetDefault("ADMIN_JWT_AUDIENCE", "supercompose-proxy-admin")
+	viper.SetDefault("IDLE_TIMEOUT", defaultIdleTimeout)
+	viper.SetDefault("SWEEP_INTERVAL", defaultSweepInterval)
+	viper.SetDefault("MAX_CONNECTIONS", 100)
+	// OpenSSH allows 10 sessions per connection by default and every pooled connection keeps a shell and sftp open
+	viper.SetDefault("CONNECTION_MAX_SESSIONS", 8)
+	viper.SetDefault("HOST_MAX_SESSIONS", 16)
+	// Session slots that shells and followed logs can not take, so that commands never wait for them
+	viper.SetDefault("RESERVED_COMMAND_SESSIONS", 2)
+	// Number of requests waiting for a session before a second connection to the host is opened, 0 disables it
+	viper.SetDefault("OVERFLOW_QUEUE_LENGTH", 0)
+	viper.SetDefault("TRANSCRIPT_PATH", "transcripts")
 	viper.AutomaticEnv()
 
+	managerCtx, stopManager := context.WithCancel(context.Background())
+	go RunConnectionManager(managerCtx)
+
 	app := iris.New()
 	app.Validator = validator.New()
 
 	app.Get("/health", func(ctx iris.Context) {
 		ctx.StatusCode(200)
 	})
+	metricsRoute(app)
 
 	app.Logger().SetLevel("debug")
 	app.Use(recover.New())
 	app.Use(logger.New())
 
+	adminRoutes(app)
+
 	verifier := jwt.NewVerifier(jwt.HS256, []byte(viper.GetString("JWT_KEY")))
 	verifier.WithDefaultBlocklist()
 	verifier.Extractors = append(verifier.Extractors, FromParameter("authorize"))
@@ -201,25 +267,48 @@ func main() {
 
 	containerStatsRoute(app)
 	dockerEventsRoute(app)
+	containerLogsRoute(app)
+	containerExecRoute(app)
+	shellRoute(app)
+	dockerStateStreamRoute(app)
+	commandStreamRoute(app)
+	imagePullRoute(app)
+	SystemdServiceLogsRoute(app)
+	SystemdEventsRoute(app)
 
 	app.Use(iris.Compression)
 
 	SystemdGetServiceRoute(app)
+	SystemdListServicesRoute(app)
 	SystemdReloadRoute(app)
 	SystemdStartServiceRoute(app)
 	SystemdStopServiceRoute(app)
 	SystemdRestartServiceRoute(app)
 	SystemdEnableServiceRoute(app)
 	SystemdDisableServiceRoute(app)
+	SystemdReconcileServiceRoute(app)
 
 	writeFileRoute(app)
 	readFileRoute(app)
 	upsertFileRoute(app)
 	deleteFileRoute(app)
+	statFileRoute(app)
+	listFilesRoute(app)
 
 	commandRoute(app)
 	containersRoute(app)
 	containerInspectRoute(app)
+	dockerStateRoute(app)
+	imagesRoute(app)
+	imageDeleteRoute(app)
+	imagePruneRoute(app)
+
+	composeUpRoute(app)
+	composeDownRoute(app)
+	composeRestartRoute(app)
+	composePullRoute(app)
+	composePsRoute(app)
+	composeConfigRoute(app)
 
 	//err := app.Listen(":8080", iris.WithSocketSharding)
 	//if err != nil {
@@ -233,9 +322,41 @@ func main() {
 
 	openTelemetryHandler := otelhttp.NewHandler(app, "Iris")
 
-	err := http.ListenAndServe(":8080", openTelemetryHandler)
-	if err != nil {
+	server := &http.Server{Addr: ":8080", Handler: openTelemetryHandler}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
 		log.Fatalf("Error while binding port 8080 %v", err)
 		return
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down", sig)
 	}
+
+	shutdown(server, stopManager)
+}
+
+// shutdown stops accepting requests, ends open SSE streams, waits for in-flight requests up to SHUTDOWN_TIMEOUT
+// and then closes all pooled SSH connections
+func shutdown(server *http.Server, stopManager context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("SHUTDOWN_TIMEOUT"))
+	defer cancel()
+
+	close(shuttingDown)
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Some requests did not finish before shutdown because %s", err)
+	}
+
+	stopManager()
+	CloseAllConnections()
+
+	log.Printf("Shutdown complete")
 }